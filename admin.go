@@ -0,0 +1,309 @@
+package cafehunter
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TomiHiltunen/geohash-golang"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+)
+
+const (
+	ADMIN_PAGE_SIZE     = 50
+	MAX_ADMIN_PAGE_SIZE = 500
+)
+
+// adminAuthorized checks the "Authorization: Bearer <token>" header against
+// cfg.AdminToken. The admin API is closed while no token is configured.
+func adminAuthorized(cfg *Config, r *http.Request) bool {
+	header := r.Header.Get("Authorization")
+	if cfg.AdminToken == "" || !strings.HasPrefix(header, "Bearer ") {
+		return false
+	}
+	token := strings.TrimPrefix(header, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(cfg.AdminToken)) == 1
+}
+
+// adminActor names who made a change in the audit log, as given by the
+// X-Admin-User header.
+func adminActor(r *http.Request) string {
+	if u := r.Header.Get("X-Admin-User"); u != "" {
+		return u
+	}
+	return "admin"
+}
+
+// adminCafesHandler serves the cafe records:
+//
+//	GET    /admin/cafes?q=&city=&offset=&limit=  list and search
+//	POST   /admin/cafes                          create
+//	GET    /admin/cafes/<id>                     get
+//	PUT    /admin/cafes/<id>                     replace
+//	PATCH  /admin/cafes/<id>                     update the given fields
+//	DELETE /admin/cafes/<id>                     delete
+func adminCafesHandler(cfg *Config, w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	if !adminAuthorized(cfg, r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/cafes"), "/")
+	switch {
+	case id == "" && r.Method == "GET":
+		listCafes(ctx, w, r)
+	case id == "" && r.Method == "POST":
+		createCafe(ctx, w, r)
+	case id != "" && r.Method == "GET":
+		getCafe(ctx, w, id)
+	case id != "" && (r.Method == "PUT" || r.Method == "PATCH"):
+		updateCafe(ctx, w, r, id)
+	case id != "" && r.Method == "DELETE":
+		deleteCafe(ctx, w, r, id)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func listCafes(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	offset, _ := strconv.Atoi(r.FormValue("offset"))
+	limit, _ := strconv.Atoi(r.FormValue("limit"))
+	if limit <= 0 {
+		limit = ADMIN_PAGE_SIZE
+	} else if limit > MAX_ADMIN_PAGE_SIZE {
+		limit = MAX_ADMIN_PAGE_SIZE
+	}
+
+	var cafes []Cafe
+	var err error
+	if city := r.FormValue("city"); city != "" {
+		cafes, err = cafeRepo.ByCity(ctx, city)
+	} else {
+		cafes, err = cafeRepo.All(ctx)
+	}
+	if err != nil {
+		log.Errorf(ctx, "can not list cafes: %s", err)
+		http.Error(w, "unable to list cafes", http.StatusInternalServerError)
+		return
+	}
+
+	if q := strings.ToLower(r.FormValue("q")); q != "" {
+		matched := []Cafe{}
+		for _, c := range cafes {
+			if strings.Contains(strings.ToLower(c.Id+" "+c.Name+" "+c.Address), q) {
+				matched = append(matched, c)
+			}
+		}
+		cafes = matched
+	}
+	sort.Slice(cafes, func(i, j int) bool { return cafes[i].Id < cafes[j].Id })
+
+	total := len(cafes)
+	if offset < 0 || offset > total {
+		offset = total
+	}
+	if offset+limit < total {
+		cafes = cafes[offset : offset+limit]
+	} else {
+		cafes = cafes[offset:]
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"total": total, "offset": offset, "cafes": cafes})
+}
+
+func getCafe(ctx context.Context, w http.ResponseWriter, id string) {
+	cafe, err := cafeRepo.ByID(ctx, id)
+	if err != nil {
+		log.Errorf(ctx, "can not get cafe %s: %s", id, err)
+		http.Error(w, "unable to get cafe", http.StatusInternalServerError)
+		return
+	}
+	if cafe == nil {
+		http.Error(w, "cafe not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, cafe)
+}
+
+func createCafe(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	cafe := Cafe{}
+	if err := json.NewDecoder(r.Body).Decode(&cafe); err != nil {
+		http.Error(w, fmt.Sprintf("invalid cafe: %s", err), http.StatusBadRequest)
+		return
+	}
+	if cafe.Id == "" {
+		cafe.Id = newCafeId()
+	}
+	if cafe.Source == "" {
+		cafe.Source = "admin"
+	}
+
+	existing, err := cafeRepo.ByID(ctx, cafe.Id)
+	if err != nil {
+		log.Errorf(ctx, "can not get cafe %s: %s", cafe.Id, err)
+		http.Error(w, "unable to create cafe", http.StatusInternalServerError)
+		return
+	}
+	if existing != nil {
+		http.Error(w, "cafe already exists", http.StatusConflict)
+		return
+	}
+	saveCafe(ctx, w, r, "create", nil, &cafe, http.StatusCreated)
+}
+
+func updateCafe(ctx context.Context, w http.ResponseWriter, r *http.Request, id string) {
+	before, err := cafeRepo.ByID(ctx, id)
+	if err != nil {
+		log.Errorf(ctx, "can not get cafe %s: %s", id, err)
+		http.Error(w, "unable to update cafe", http.StatusInternalServerError)
+		return
+	}
+	if before == nil {
+		http.Error(w, "cafe not found", http.StatusNotFound)
+		return
+	}
+
+	// PATCH decodes the body over the stored cafe, so absent fields are kept
+	after := Cafe{}
+	if r.Method == "PATCH" {
+		after = *before
+	}
+	if err := json.NewDecoder(r.Body).Decode(&after); err != nil {
+		http.Error(w, fmt.Sprintf("invalid cafe: %s", err), http.StatusBadRequest)
+		return
+	}
+	if after.Id != id {
+		http.Error(w, "cafe id can not be changed", http.StatusBadRequest)
+		return
+	}
+	// the source tells imports whether the cafe is theirs, so PUT keeps it
+	after.Source = before.Source
+	saveCafe(ctx, w, r, "update", before, &after, http.StatusOK)
+}
+
+func deleteCafe(ctx context.Context, w http.ResponseWriter, r *http.Request, id string) {
+	before, err := cafeRepo.ByID(ctx, id)
+	if err != nil {
+		log.Errorf(ctx, "can not get cafe %s: %s", id, err)
+		http.Error(w, "unable to delete cafe", http.StatusInternalServerError)
+		return
+	}
+	if before == nil {
+		http.Error(w, "cafe not found", http.StatusNotFound)
+		return
+	}
+
+	if err := cafeRepo.Update(ctx, nil, []string{id}); err != nil {
+		log.Errorf(ctx, "can not delete cafe %s: %s", id, err)
+		http.Error(w, "unable to delete cafe", http.StatusInternalServerError)
+		return
+	}
+	audit(ctx, r, "delete", before, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// saveCafe validates and stores a created or updated cafe, recomputing the
+// fields derived from others and marking it as edited so that imports keep
+// it, and audits the change. It reports whether the cafe was saved, the
+// response having been written either way.
+func saveCafe(ctx context.Context, w http.ResponseWriter, r *http.Request, action string, before, after *Cafe, status int) bool {
+	after.Geohash = geohash.Encode(after.Latitude, after.Longitude)
+	now := time.Now()
+	after.EditedAt = &now
+	if err := validateCafe(*after); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+
+	if err := cafeRepo.Update(ctx, []Cafe{*after}, nil); err != nil {
+		log.Errorf(ctx, "can not save cafe %s: %s", after.Id, err)
+		http.Error(w, "unable to save cafe", http.StatusInternalServerError)
+		return false
+	}
+	audit(ctx, r, action, before, after)
+	writeJSON(w, status, after)
+	return true
+}
+
+// audit records a change that has been made. A failure to record it is
+// logged, with the change itself, rather than reported to the admin since
+// the change can not be undone.
+func audit(ctx context.Context, r *http.Request, action string, before, after *Cafe) {
+	entry := auditEntry{
+		Time:   time.Now(),
+		Actor:  adminActor(r),
+		Action: action,
+		Before: before,
+		After:  after,
+	}
+	if after != nil {
+		entry.CafeId = after.Id
+	} else {
+		entry.CafeId = before.Id
+	}
+
+	log.Infof(ctx, "admin %s %s cafe %s", entry.Actor, action, entry.CafeId)
+	if err := auditLog.Record(ctx, entry); err != nil {
+		log.Criticalf(ctx, "can not record audit entry %+v: %s", entry, err)
+	}
+}
+
+// newCafeId returns a random id for a cafe created without one.
+func newCafeId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// validateCafe checks the fields of a cafe before it is stored.
+func validateCafe(c Cafe) error {
+	if c.Id == "" || strings.ContainsAny(c.Id, ".$#[]/") {
+		return fmt.Errorf("invalid id %q", c.Id)
+	}
+	if strings.TrimSpace(c.Name) == "" {
+		return fmt.Errorf("name is required")
+	}
+	// Taiwan, Penghu, Kinmen and Matsu
+	if c.Latitude < 21.5 || c.Latitude > 26.5 || c.Longitude < 118 || c.Longitude > 122.5 {
+		return fmt.Errorf("coordinates %f,%f are not in Taiwan", c.Latitude, c.Longitude)
+	}
+	for _, rating := range []struct {
+		name  string
+		value float64
+	}{
+		{"wifi", c.Wifi}, {"seat", c.Seat}, {"quiet", c.Quiet},
+		{"tasty", c.Tasty}, {"cheap", c.Price}, {"music", c.Music},
+	} {
+		if rating.value < 0 || rating.value > 5 {
+			return fmt.Errorf("%s must be between 0 and 5", rating.name)
+		}
+	}
+	for _, answer := range []struct {
+		name  string
+		value string
+	}{
+		{"timeLimited", c.TimeLimited}, {"plug", c.Plug},
+	} {
+		switch answer.value {
+		case "", "yes", "maybe", "no":
+		default:
+			return fmt.Errorf("%s must be yes, maybe or no", answer.name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package cafehunter
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// auditEntry records a change to a cafe: who made it, and the cafe before
+// and after. Before is nil for a created cafe and After for a deleted one.
+type auditEntry struct {
+	Time   time.Time `json:"time"`
+	Actor  string    `json:"actor"`
+	Action string    `json:"action"`
+	CafeId string    `json:"cafeId"`
+	Before *Cafe     `json:"before,omitempty"`
+	After  *Cafe     `json:"after,omitempty"`
+}
+
+// AuditLog keeps the changes made to cafes through the admin API.
+type AuditLog interface {
+	Record(ctx context.Context, entry auditEntry) error
+}
+
+var auditLog AuditLog
+
+// newAuditLog keeps the audit log next to the cafes: in memory when they are
+// served from cfg.CafeDataFile and in Firebase otherwise.
+func newAuditLog(cfg *Config) AuditLog {
+	if cfg.CafeDataFile != "" {
+		return &memoryAuditLog{}
+	}
+	return &firebaseAuditLog{}
+}
+
+// memoryAuditLog keeps the entries of a single instance, e.g. for local
+// runs.
+type memoryAuditLog struct {
+	mu      sync.Mutex
+	entries []auditEntry
+}
+
+func (l *memoryAuditLog) Record(ctx context.Context, entry auditEntry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = append(l.entries, entry)
+	return nil
+}
+
+// firebaseAuditLog appends entries to the "audit" path of Firebase.
+type firebaseAuditLog struct{}
+
+func (l *firebaseAuditLog) Record(ctx context.Context, entry auditEntry) error {
+	_, err := newFirebaseClient(ctx).Child("audit").Push(entry)
+	return err
+}
@@ -1,5 +1,15 @@
 package cafehunter
 
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/TomiHiltunen/geohash-golang"
+)
+
 type Cafe struct {
 	Id   string `json:"id"`
 	Name string `json:"name"`
@@ -15,9 +25,109 @@ type Cafe struct {
 	TimeLimited string `json:"timeLimited"`
 	Plug        string `json:"plug"`
 
+	// OpenTime is the opening hours as written on cafenomad, read by
+	// openingHours.
+	OpenTime string `json:"openTime"`
+
 	Address   string  `json:"address"`
 	Link      string  `json:"url"`
 	Latitude  float64 `json:"latitude,string"`
 	Longitude float64 `json:"longitude,string"`
 	Geohash   string  `json:"geohash"`
+
+	// Source is empty for cafes imported from cafenomad, "admin" for cafes
+	// admins created and "user" for cafes users submitted, which imports
+	// leave alone.
+	Source string `json:"source,omitempty"`
+
+	// EditedAt is when an admin last saved the cafe, nil for cafes only
+	// ever imported. Imports neither overwrite nor remove edited cafes.
+	EditedAt *time.Time `json:"editedAt,omitempty"`
+
+	// Distance is the distance in meters from the point of a search.
+	Distance float64 `json:"-"`
+
+	// Detour is the distance in meters off the route of a route search.
+	Detour float64 `json:"-"`
+
+	// Reviews are the ratings users of the bot gave the cafe, kept apart
+	// from the imported ones and filled in by withReviews.
+	Reviews ratingSummary `json:"-"`
+}
+
+// openingHours returns the schedule parsed from OpenTime, nil when unknown.
+// The schedule is not stored, as Firebase would keep the weekdays without
+// hours out of its array.
+func (c Cafe) openingHours() *OpeningHours {
+	return parseOpeningHours(c.OpenTime)
+}
+
+// nomadCafe is a cafe as published by the Cafe Nomad API.
+type nomadCafe struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+	City string `json:"city"`
+
+	Wifi  float64 `json:"wifi"`
+	Seat  float64 `json:"seat"`
+	Quiet float64 `json:"quiet"`
+	Tasty float64 `json:"tasty"`
+	Cheap float64 `json:"cheap"`
+	Music float64 `json:"music"`
+
+	URL         string `json:"url"`
+	Address     string `json:"address"`
+	Latitude    string `json:"latitude"`
+	Longitude   string `json:"longitude"`
+	LimitedTime string `json:"limited_time"`
+	Socket      string `json:"socket"`
+	OpenTime    string `json:"open_time"`
+}
+
+func (n nomadCafe) toCafe() (cafe Cafe, err error) {
+	cafe = Cafe{
+		Id:          n.Id,
+		Name:        n.Name,
+		City:        n.City,
+		Wifi:        n.Wifi,
+		Seat:        n.Seat,
+		Quiet:       n.Quiet,
+		Tasty:       n.Tasty,
+		Price:       n.Cheap,
+		Music:       n.Music,
+		TimeLimited: n.LimitedTime,
+		Plug:        n.Socket,
+		OpenTime:    n.OpenTime,
+		Address:     n.Address,
+		Link:        n.URL,
+	}
+	if cafe.Latitude, err = strconv.ParseFloat(n.Latitude, 64); err != nil {
+		return cafe, fmt.Errorf("invalid latitude of cafe %s: %s", n.Id, err)
+	}
+	if cafe.Longitude, err = strconv.ParseFloat(n.Longitude, 64); err != nil {
+		return cafe, fmt.Errorf("invalid longitude of cafe %s: %s", n.Id, err)
+	}
+	cafe.Geohash = geohash.Encode(cafe.Latitude, cafe.Longitude)
+	return
+}
+
+// decodeNomadCafes reads a cafenomad-format JSON array. Cafes that can not
+// be converted, such as those without valid coordinates, are skipped rather
+// than failing the whole array, and returned as skipped by id.
+func decodeNomadCafes(r io.Reader) (cafes []Cafe, skipped []string, err error) {
+	nomadCafes := []nomadCafe{}
+	if err := json.NewDecoder(r).Decode(&nomadCafes); err != nil {
+		return nil, nil, err
+	}
+
+	cafes = make([]Cafe, 0, len(nomadCafes))
+	for _, n := range nomadCafes {
+		cafe, err := n.toCafe()
+		if err != nil {
+			skipped = append(skipped, n.Id)
+			continue
+		}
+		cafes = append(cafes, cafe)
+	}
+	return cafes, skipped, nil
 }
@@ -7,7 +7,7 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
-	"sync"
+	"time"
 
 	"golang.org/x/net/context"
 	"google.golang.org/appengine"
@@ -15,23 +15,19 @@ import (
 	"google.golang.org/appengine/urlfetch"
 	"googlemaps.github.io/maps"
 
-	"github.com/TomiHiltunen/geohash-golang"
 	"github.com/lemonlatte/ambassador"
 	"github.com/looplab/fsm"
 	"gopkg.in/zabawaba99/firego.v1"
 )
 
 const (
-	BOT_TOKEN       = ""
-	PAGE_TOKEN      = ""
-	GOOG_MAP_APIKEY = ""
-	FIREBASE_AUTH_TOKEN = ""
-
-	FBMessageURI = "https://graph.facebook.com/v2.6/me/messages?access_token=" + PAGE_TOKEN
+	PAGE_SIZE    = 10 // the most elements a generic template can hold
 	WELCOME_TEXT = `你好，歡迎使用 Café Hunter。請用簡單的句子跟我對話，例如：「我要找咖啡店」、「我想喝咖啡」、「士林有什麼推薦的咖啡店嗎？」`
 )
 
-var lock sync.Mutex = sync.Mutex{}
+// userLocks serializes the messages of each user within this instance, see
+// keyedMutex for the messages handled by other instances.
+var userLocks = newKeyedMutex()
 
 type Location struct {
 	Latitude  float64 `json:"lat"`
@@ -39,14 +35,35 @@ type Location struct {
 }
 
 type User struct {
-	Id         string
-	State      string
-	FSM        *fsm.FSM
-	TodoAction string
-	LastText   string
+	Id         string    `json:"id"`
+	State      string    `json:"state"`
+	FSM        *fsm.FSM  `json:"-"`
+	LastActive time.Time `json:"lastActive"`
+
+	// LastText is the place the user last asked about, the text the next
+	// search is recorded under in History.
+	LastText string         `json:"lastText,omitempty"`
+	History  []searchRecord `json:"history,omitempty"`
+
+	// Filter and Profile hold the attributes and the ranking asked for in
+	// the conversation so far.
+	Filter  CafeFilter `json:"filter,omitempty"`
+	Profile string     `json:"profile,omitempty"`
+
+	// LastCafe is the id of the cafe the user last looked at, which "像這家的"
+	// refers to.
+	LastCafe string `json:"lastCafe,omitempty"`
+
+	// Preferences are kept across conversations and apply to every search.
+	Preferences Preferences `json:"preferences"`
+
+	// Submission is the cafe the user is telling us about in "新增咖啡店".
+	Submission *cafeSubmission `json:"submission,omitempty"`
 }
 
-var users map[string]*User = map[string]*User{}
+var sessions SessionStore
+
+var cafeRepo CafeRepository
 
 type Place struct {
 	Name             string
@@ -56,10 +73,61 @@ type Place struct {
 }
 
 func init() {
-	http.HandleFunc("/fbCallback", fbCBHandler)
+	var err error
+	config, configErr = loadConfig()
+	sessions = newSessionStore(config)
+	auditLog = newAuditLog(config)
+	favorites = newFavoriteStore(config)
+	ratings = newRatingStore(config)
+	submissions = newSubmissionStore(config)
+	geocodes = newGeocodeCache(time.Duration(config.GeocodeCacheTTL), config.GeocodeCacheSize, newGeocodeBackend(config))
+	if cafeRepo, err = newCafeRepository(config); err != nil && configErr == nil {
+		configErr = err
+	}
+	if metro, err = loadMetro(config.MetroFile); err != nil {
+		metro = &metroCatalogue{}
+		if configErr == nil {
+			configErr = fmt.Errorf("can not load metro stations %s: %s", config.MetroFile, err)
+		}
+	}
+	if geocoder, err = newGeocoder(config, metro); err != nil && configErr == nil {
+		configErr = err
+	}
+
+	http.HandleFunc("/fbCallback", configured(fbCBHandler))
+	http.HandleFunc("/tasks/expireSessions", configured(expireSessionsHandler))
+	http.HandleFunc("/tasks/geocodeCacheStats", geocodeCacheStatsHandler)
+	http.HandleFunc("/tasks/importCafes", configured(importCafesHandler))
+	http.HandleFunc("/admin/cafes", configured(adminCafesHandler))
+	http.HandleFunc("/admin/cafes/", configured(adminCafesHandler))
+	http.HandleFunc("/admin/submissions", configured(adminSubmissionsHandler))
+	http.HandleFunc("/admin/submissions/", configured(adminSubmissionsHandler))
 	http.HandleFunc("/", handler)
 }
 
+// configuredHandler is a handler depending on the configuration, which is
+// passed in so that tests can serve it with their own.
+type configuredHandler func(cfg *Config, w http.ResponseWriter, r *http.Request)
+
+// configured refuses to serve a handler that depends on secrets until the
+// configuration loaded at startup is valid, and then serves it with that
+// configuration.
+func configured(h configuredHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if configErr != nil {
+			log.Criticalf(appengine.NewContext(r), "invalid configuration: %s", configErr)
+			http.Error(w, "service is not configured", http.StatusInternalServerError)
+			return
+		}
+		h(config, w, r)
+	}
+}
+
+// newAmbassador returns the Messenger client of the page.
+var newAmbassador = func(ctx context.Context, cfg *Config) ambassador.Ambassador {
+	return ambassador.NewFBAmbassador(cfg.PageToken, urlfetch.Client(ctx))
+}
+
 func handler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, "Hi, do you love drinking coffe?")
 }
@@ -78,7 +146,35 @@ func pointToStar(point float64) (starString string) {
 	return
 }
 
-func cafeToFBTemplate(cafes []Cafe) (summary, items interface{}, n int) {
+// searchResultButtons are the buttons of a cafe in search results.
+func searchResultButtons(cafe Cafe) []ambassador.FBButtonItem {
+	return []ambassador.FBButtonItem{
+		// ambassador.FBButtonItem{
+		// 	Type:  "web_url",
+		// 	Title: "View in Maps",
+		// 	Url:   fmt.Sprintf("http://maps.apple.com/maps?q=%s&z=16", cafe.Address),
+		// },
+		ambassador.FBButtonItem{
+			Type:    "postback",
+			Title:   "詳細資訊",
+			Payload: fmt.Sprintf("CAFE_DETAIL:%s", cafe.Id),
+		},
+		ambassador.FBButtonItem{
+			Type:    "postback",
+			Title:   "找相似的",
+			Payload: fmt.Sprintf("SIMILAR_TO:%s", cafe.Id),
+		},
+		ambassador.FBButtonItem{
+			Type:    "postback",
+			Title:   "收藏",
+			Payload: fmt.Sprintf("FAVORITE_ADD:%s", cafe.Id),
+		},
+	}
+}
+
+// cafeToFBTemplate renders the map of all cafes as summary and a page of at
+// most size cafes starting at offset as items, each with the given buttons.
+func cafeToFBTemplate(cafes []Cafe, offset, size int, buttons func(Cafe) []ambassador.FBButtonItem) (summary, items interface{}, n int) {
 	resultItems := []map[string]interface{}{}
 
 	if len(cafes) == 0 {
@@ -86,37 +182,18 @@ func cafeToFBTemplate(cafes []Cafe) (summary, items interface{}, n int) {
 	}
 
 	markers := []string{}
+	now := time.Now()
 
-	for _, cafe := range cafes {
+	for i, cafe := range cafes {
 		markers = append(markers, fmt.Sprintf("%f,%f", cafe.Latitude, cafe.Longitude))
 
-		if len(resultItems) < 10 {
+		if i >= offset && len(resultItems) < size {
 			element := map[string]interface{}{
 				"title":     fmt.Sprintf("%s", cafe.Name),
 				"image_url": fmt.Sprintf("https://maps.googleapis.com/maps/api/staticmap?markers=%f,%f&zoom=15&size=400x200", cafe.Latitude, cafe.Longitude),
 				"item_url":  cafe.Link,
-				"subtitle": fmt.Sprintf(
-					"好喝: %s | Wifi: %s \n安靜: %s | 便宜: %s\n地址: %s",
-					pointToStar(cafe.Tasty), pointToStar(cafe.Wifi),
-					pointToStar(cafe.Quiet), pointToStar(cafe.Price),
-					cafe.Address),
-				"buttons": []ambassador.FBButtonItem{
-					// ambassador.FBButtonItem{
-					// 	Type:  "web_url",
-					// 	Title: "View in Maps",
-					// 	Url:   fmt.Sprintf("http://maps.apple.com/maps?q=%s&z=16", cafe.Address),
-					// },
-					ambassador.FBButtonItem{
-						Type:  "web_url",
-						Title: "View in Cafenomad",
-						Url:   fmt.Sprintf("https://cafenomad.tw/shop/%s", cafe.Id),
-					},
-					ambassador.FBButtonItem{
-						Type:  "web_url",
-						Title: "View in Google Maps",
-						Url:   fmt.Sprintf("https://maps.google.com/?q=%s", cafe.Address),
-					},
-				},
+				"subtitle":  cafeSubtitle(cafe, now),
+				"buttons":   buttons(cafe),
 			}
 			resultItems = append(resultItems, element)
 		}
@@ -137,75 +214,100 @@ func cafeToFBTemplate(cafes []Cafe) (summary, items interface{}, n int) {
 	return summaryItems, resultItems, len(cafes)
 }
 
-func findCafeByGeocoding(ctx context.Context, lat, long float64, precision int) []Cafe {
-	filteredCafes := []Cafe{}
+const (
+	SUBTITLE_LIMIT          = 80 // characters Messenger shows in the subtitle of a template element
+	QUICK_REPLY_TITLE_LIMIT = 20 // characters Messenger accepts in the title of a quick reply
+)
 
-	h := geohash.EncodeWithPrecision(lat, long, precision)
-	areas := geohash.CalculateAllAdjacent(h)
-	areas = append(areas, h)
-	client := urlfetch.Client(ctx)
+// cafeSubtitle sums up a cafe in a carousel: how far it is, its ratings on
+// one line, what users rated it with today's hours on another, then its
+// address when there is room left. The detail view has the rest.
+func cafeSubtitle(cafe Cafe, now time.Time) string {
+	lines := []string{}
+	// cafes along a route are as far as they are off it, and cafes not
+	// found by a search, such as favorites, have no distance
+	if cafe.Detour > 0 {
+		lines = append(lines, fmt.Sprintf("離路線 %.0f 公尺", cafe.Detour))
+	} else if cafe.Distance > 0 {
+		lines = append(lines, walkingText(cafe.Distance))
+	}
+	hours := cafe.openingHours().Today(now)
+	if cafe.Reviews.Count > 0 {
+		hours = fmt.Sprintf("網友 %.1f (%d 人)｜%s", cafe.Reviews.Overall(), cafe.Reviews.Count, hours)
+	}
+	lines = append(lines,
+		fmt.Sprintf("好喝 %s｜Wifi %s｜安靜 %s｜便宜 %s",
+			scoreText(cafe.Tasty), scoreText(cafe.Wifi), scoreText(cafe.Quiet), scoreText(cafe.Price)),
+		hours,
+		cafe.Address,
+	)
+	return fitLines(lines, SUBTITLE_LIMIT)
+}
 
-	firegoClient := firego.New("https://cafe-hunter.firebaseio.com", client)
-	firegoClient.Auth(FIREBASE_AUTH_TOKEN)
+// scoreText shows a rating as its value, or "-" when the cafe is not rated.
+func scoreText(rating float64) string {
+	if rating <= 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f", rating)
+}
 
-	for _, a := range areas {
-		v := map[string]Cafe{}
-		err := firegoClient.Child("cafes").OrderBy("geohash").StartAt(a).EndAt(a + "~").Value(&v)
-		if err != nil {
-			log.Errorf(ctx, "can not fetch cafes: %s", err.Error())
+// fitLines joins lines in at most limit characters, cutting short the first
+// line that does not fit and leaving out the lines after it.
+func fitLines(lines []string, limit int) string {
+	text := []rune{}
+	for i, line := range lines {
+		if i > 0 {
+			line = "\n" + line
 		}
-		for _, cafe := range v {
-			filteredCafes = append(filteredCafes, cafe)
+		room := limit - len(text)
+		if l := []rune(line); len(l) > room {
+			if room > 2 {
+				text = append(text, l[:room-1]...)
+				text = append(text, '…')
+			}
+			break
 		}
+		text = append(text, []rune(line)...)
 	}
+	return string(text)
+}
 
-	return filteredCafes
+// findCafeByGeocoding returns the cafes within radius meters of a point,
+// nearest first.
+func findCafeByGeocoding(ctx context.Context, lat, long, radius float64) ([]Cafe, error) {
+	return cafeRepo.Nearby(ctx, lat, long, radius)
 }
 
-func resolveGeocoding(ctx context.Context, location string) (places []Place, err error) {
+// replyCafesNearby searches the cafes matching a query and sends them to the
+// user, telling the user when the search itself fails.
+func replyCafesNearby(ctx context.Context, a ambassador.Ambassador, senderId string, q cafeQuery) error {
+	search, err := searchCafes(ctx, q)
+	if err != nil {
+		log.Errorf(ctx, "can not fetch cafes: %s", err.Error())
+		return a.SendText(senderId, "查詢咖啡店時發生錯誤，請稍後再試")
+	}
+	search.Cafes = withReviews(ctx, search.Cafes, search.Query.Offset, search.Query.pageSize())
+	return sendCafeMessages(a, search, senderId)
+}
+
+func newFirebaseClient(ctx context.Context) *firego.Firebase {
 	client := urlfetch.Client(ctx)
-	c, err := maps.NewClient(maps.WithAPIKey(GOOG_MAP_APIKEY), maps.WithHTTPClient(client))
+	firegoClient := firego.New(config.FirebaseURL, client)
+	firegoClient.Auth(config.FirebaseAuthToken)
+	return firegoClient
+}
+
+var geocoder Geocoder
+
+func resolveGeocoding(ctx context.Context, location string) (places []Place, err error) {
+	places, err = geocoder.Geocode(ctx, location)
 	if err != nil {
-		log.Errorf(ctx, "can not create google map api client: %s", err)
+		log.Errorf(ctx, "can not resolve location %s: %s", location, err)
 		return
 	}
-
-	places = make([]Place, 0)
-	placesResp, err := c.TextSearch(ctx, &maps.TextSearchRequest{
-		Query:    fmt.Sprintf("%s+in+Taiwan", location),
-		Language: "zh-TW",
-	})
-	if err == nil && len(placesResp.Results) > 0 {
-		for _, r := range placesResp.Results {
-			p := Place{
-				Name:             r.Name,
-				Geometry:         r.Geometry,
-				FormattedAddress: r.FormattedAddress,
-				PlaceID:          r.PlaceID,
-			}
-			places = append(places, p)
-		}
-	} else {
-		geocodingResults, err := c.Geocode(ctx, &maps.GeocodingRequest{
-			Address: location,
-			Components: map[maps.Component]string{
-				maps.ComponentCountry: "TW",
-			},
-			Language: "zh-TW",
-		})
-		if err == nil && len(geocodingResults) > 0 {
-			for _, r := range geocodingResults {
-				p := Place{
-					Name:             r.FormattedAddress,
-					Geometry:         r.Geometry,
-					FormattedAddress: r.FormattedAddress,
-					PlaceID:          r.PlaceID,
-				}
-				places = append(places, p)
-			}
-		} else {
-			log.Warningf(ctx, "no results found")
-		}
+	if len(places) == 0 {
+		log.Warningf(ctx, "no results found")
 	}
 
 	if len(places) > 8 {
@@ -215,53 +317,122 @@ func resolveGeocoding(ctx context.Context, location string) (places []Place, err
 }
 
 func findCafeByLocation(ctx context.Context, location string) (cafes []Cafe, err error) {
-	client := urlfetch.Client(ctx)
-	c, err := maps.NewClient(maps.WithAPIKey(GOOG_MAP_APIKEY), maps.WithHTTPClient(client))
-	if err != nil {
-		log.Errorf(ctx, "can not get geocoding: %s", err)
-		return
-	}
-
-	results, err := c.Geocode(ctx, &maps.GeocodingRequest{Address: location})
+	places, err := resolveGeocoding(ctx, location)
 	if err != nil {
 		log.Errorf(ctx, "can not get geocoding: %s", err)
 		return
 	}
 
-	if len(results) == 0 {
+	if len(places) == 0 {
 		log.Warningf(ctx, "no location found")
 		return
 	}
 
-	lat := results[0].Geometry.Location.Lat
-	long := results[0].Geometry.Location.Lng
+	lat := places[0].Geometry.Location.Lat
+	long := places[0].Geometry.Location.Lng
 
-	return findCafeByGeocoding(ctx, lat, long, 7), nil
+	return findCafeByGeocoding(ctx, lat, long, config.SearchRadius)
 }
 
-func sendCafeMessages(a ambassador.Ambassador, filteredCafes []Cafe, senderId string) (err error) {
-	summary, items, n := cafeToFBTemplate(filteredCafes)
+// sendCafeMessages sends the page of a search starting at its query offset.
+// The first page comes with the number of cafes found and a map of them.
+func sendCafeMessages(a ambassador.Ambassador, search *cafeSearch, senderId string) (err error) {
+	offset := search.Query.Offset
+	summary, items, n := cafeToFBTemplate(search.Cafes, offset, search.Query.pageSize(), searchResultButtons)
+
+	kind := "咖啡店"
+	if len(search.Query.Filter) > 0 {
+		kind = fmt.Sprintf("%s的咖啡店", search.Query.Filter.Description())
+	}
 
 	if n == 0 {
-		err = a.SendText(senderId, "無法在我的記憶裡找到那附近的咖啡店。")
+		err = a.SendText(senderId, fmt.Sprintf("找遍了方圓 %s，無法在我的記憶裡找到那附近%s。", radiusText(search.Radius), kind))
+	} else if offset >= n {
+		err = a.SendText(senderId, "沒有更多咖啡店了。")
 	} else {
-		if err = a.SendTemplate(senderId, summary); err != nil {
+		if offset == 0 {
+			if err = a.SendText(senderId, fmt.Sprintf("在方圓 %s 內找到 %d 家%s", radiusText(search.Radius), n, kind)); err != nil {
+				return
+			}
+			if err = a.SendTemplate(senderId, summary); err != nil {
+				return
+			}
+		}
+		if err = a.SendTemplate(senderId, items); err != nil {
 			return
 		}
-		err = a.SendTemplate(senderId, items)
+		err = askSearchFollowUp(a, search, senderId)
 	}
 	return
 }
 
-func askLocationConfirm(a ambassador.Ambassador, places []Place, senderId string) (err error) {
+// askSearchFollowUp offers the next page of a search and to sort it with
+// another scoring profile. The search radius is kept in the payloads so the
+// follow-up shows the same cafes.
+func askSearchFollowUp(a ambassador.Ambassador, search *cafeSearch, senderId string) error {
+	q := search.Query
+	q.Radius = search.Radius
+
+	replies := []map[string]string{}
+	if next := q.Offset + q.pageSize(); next < len(search.Cafes) {
+		more := q
+		more.Offset = next
+		replies = append(replies, map[string]string{
+			"content_type": "text",
+			"title":        "看更多",
+			"payload":      more.payload("FIND_CAFE_PAGE"),
+		})
+	}
+
+	q.Offset = 0
+	for _, p := range scoringProfiles {
+		if p.Name == q.Profile {
+			continue
+		}
+		ranked := q
+		ranked.Profile = p.Name
+		replies = append(replies, map[string]string{
+			"content_type": "text",
+			"title":        p.Title,
+			"payload":      ranked.payload("FIND_CAFE_GEOCODING"),
+		})
+	}
+	if q.Profile != "" {
+		nearest := q
+		nearest.Profile = ""
+		replies = append(replies, map[string]string{
+			"content_type": "text",
+			"title":        "離我最近",
+			"payload":      nearest.payload("FIND_CAFE_GEOCODING"),
+		})
+	}
+
+	first := search.Query.Offset + 1
+	last := search.Query.Offset + search.Query.pageSize()
+	if last > len(search.Cafes) {
+		last = len(search.Cafes)
+	}
+	order := "距離"
+	if p := findScoringProfile(q.Profile); p != nil {
+		order = p.Title
+	}
+	text := fmt.Sprintf("以上是依「%s」排序的第 %d 到 %d 家，想換個排序方式嗎？", order, first, last)
+	return a.AskQuestion(senderId, text, replies)
+}
+
+// placeQuery builds a query for the cafes around a resolved place with the
+// filter and profile the user asked for.
+func placeQuery(p Place, user *User) cafeQuery {
+	return user.newQuery(p.Geometry.Location.Lat, p.Geometry.Location.Lng)
+}
+
+func askLocationConfirm(a ambassador.Ambassador, places []Place, user *User) (err error) {
 	locationChoiceReplies := []map[string]string{}
 	for _, p := range places {
-		lat := p.Geometry.Location.Lat
-		long := p.Geometry.Location.Lng
 		locationChoiceReplies = append(locationChoiceReplies, map[string]string{
 			"content_type": "text",
 			"title":        p.Name,
-			"payload":      fmt.Sprintf("FIND_CAFE_GEOCODING:%f,%f", lat, long),
+			"payload":      placeQuery(p, user).payload("FIND_CAFE_GEOCODING"),
 		})
 
 	}
@@ -273,7 +444,7 @@ func askLocationConfirm(a ambassador.Ambassador, places []Place, senderId string
 		"content_type": "location",
 	})
 	text := "範圍不夠清楚，幫我從下方選出最接近的位置"
-	err = a.AskQuestion(senderId, text, locationChoiceReplies)
+	err = a.AskQuestion(user.Id, text, locationChoiceReplies)
 	return
 }
 
@@ -288,19 +459,18 @@ func confirmLocation(ctx context.Context, locations []string, user *User, a amba
 		var places []Place
 		places, err = resolveGeocoding(ctx, location)
 
+		if len(places) > 0 {
+			user.LastText = location
+		}
 		if len(places) > 1 {
 			user.FSM.Event("getConfusedLocation")
-			err = askLocationConfirm(a, places, user.Id)
+			err = askLocationConfirm(a, places, user)
 		} else {
 			user.FSM.Event("responeResult")
 			if len(places) == 0 {
 				err = a.SendText(user.Id, "很抱歉，無法在我的地圖上找到這個地點")
 			} else if len(places) == 1 {
-				var filteredCafes []Cafe
-				lat := places[0].Geometry.Location.Lat
-				long := places[0].Geometry.Location.Lng
-				filteredCafes = findCafeByGeocoding(ctx, lat, long, 7)
-				err = sendCafeMessages(a, filteredCafes, user.Id)
+				err = searchNearby(ctx, a, user, placeQuery(places[0], user))
 			}
 		}
 	} else {
@@ -325,9 +495,29 @@ func confirmLocation(ctx context.Context, locations []string, user *User, a amba
 	return
 }
 
-func contextAnalysis(ctx context.Context, user *User, message string, a ambassador.Ambassador) (err error) {
+func contextAnalysis(ctx context.Context, cfg *Config, user *User, message string, a ambassador.Ambassador) (err error) {
+	if strings.Contains(message, "沿線") {
+		return lineSearchHandler(ctx, user, message, a)
+	}
+	if isSimilarQuestion(message) {
+		return similarTextHandler(ctx, user, a)
+	}
+	if strings.Contains(message, "我的收藏") {
+		return replyFavorites(ctx, a, user, 0)
+	}
+	if strings.Contains(message, "新增咖啡店") {
+		return startSubmission(a, user)
+	}
+	if strings.Contains(message, "最近查詢") {
+		return replyHistory(a, user)
+	}
+	if strings.Contains(message, "設定") {
+		user.FSM.Event("openSettings")
+		return askSettings(a, user, "")
+	}
+
 	tr := &urlfetch.Transport{Context: ctx}
-	r, err := fetchIntent(tr.RoundTrip, message, false)
+	r, err := fetchIntent(cfg, tr.RoundTrip, message, false)
 	log.Infof(ctx, "LUIS Result: %+v", r)
 	if err != nil {
 		err = a.SendText(user.Id, "機器人的識別功能發生故障")
@@ -338,8 +528,20 @@ func contextAnalysis(ctx context.Context, user *User, message string, a ambassad
 				locations = append(locations, e.Entity)
 			}
 		}
+		user.Filter = filterFromEntities(r.Entities).merge(filterFromText(message))
+		user.Profile = profileFromText(message)
 
-		if r.TopScoringIntent.Intent == "FindCafe" {
+		if kind, ok := savedPlaceInText(message); ok {
+			err = replySavedPlace(ctx, a, user, kind)
+		} else if isRouteQuestion(message, r.TopScoringIntent.Intent) {
+			user.FSM.Event("receiveIntent")
+			if from, to, ok := routeEnds(message, locations); ok {
+				err = routeSearchHandler(ctx, user, from, to, a)
+			} else {
+				user.FSM.Event("cancel")
+				err = a.SendText(user.Id, "請告訴我起點和終點，例如「從台北車站到西門町的路上」")
+			}
+		} else if r.TopScoringIntent.Intent == "FindCafe" {
 			user.FSM.Event("receiveIntent")
 			if len(locations) > 0 {
 				err = confirmLocation(ctx, locations, user, a)
@@ -350,12 +552,13 @@ func contextAnalysis(ctx context.Context, user *User, message string, a ambassad
 					map[string]string{
 						"content_type": "location",
 					},
-					map[string]string{
-						"content_type": "text",
-						"title":        "取消",
-						"payload":      "CANCEL",
-					},
 				}
+				quickReplies = append(quickReplies, savedPlaceReplies(user)...)
+				quickReplies = append(quickReplies, map[string]string{
+					"content_type": "text",
+					"title":        "取消",
+					"payload":      "CANCEL",
+				})
 				err = a.AskQuestion(user.Id, text, quickReplies)
 			}
 		} else {
@@ -380,24 +583,49 @@ func newUser(senderId string) *User {
 		Id:    senderId,
 		State: "STANDBY",
 	}
-	user.FSM = fsm.NewFSM("STANDBY", fsm.Events{
-		{Name: "greeting", Src: []string{"STANDBY"}, Dst: "STANDBY"},
-		{Name: "receiveGeocoding", Src: []string{"STANDBY", "UNSURE_LOCATION"}, Dst: "LOCATION_CONFIRMED"},
-		{Name: "receiveAddress", Src: []string{"STANDBY", "UNSURE_LOCATION"}, Dst: "LOCATION_CONFIRMED"},
-		{Name: "unknownIntent", Src: []string{"STANDBY"}, Dst: "STANDBY"},
-		{Name: "receiveIntent", Src: []string{"STANDBY"}, Dst: "INTENT_CONFIRMED"},
+	user.attachFSM()
+	return user
+}
 
-		// {Name: "unknownLocation", Src: []string{"INTENT_CONFIRMED"}, Dst: "UNKNOWN_LOCATION"},
-		{Name: "getConfusedLocation", Src: []string{"STANDBY", "INTENT_CONFIRMED"}, Dst: "UNSURE_LOCATION"},
-		{Name: "responeResult", Src: []string{"INTENT_CONFIRMED", "UNSURE_LOCATION", "LOCATION_CONFIRMED"}, Dst: "STANDBY"},
+// conversationEvents are the transitions between the states of a
+// conversation, STANDBY being the state of a user not in the middle of one.
+var conversationEvents = fsm.Events{
+	{Name: "greeting", Src: []string{"STANDBY"}, Dst: "STANDBY"},
+	{Name: "receiveGeocoding", Src: []string{"STANDBY", "UNSURE_LOCATION"}, Dst: "LOCATION_CONFIRMED"},
+	{Name: "receiveAddress", Src: []string{"STANDBY", "UNSURE_LOCATION"}, Dst: "LOCATION_CONFIRMED"},
+	{Name: "unknownIntent", Src: []string{"STANDBY"}, Dst: "STANDBY"},
+	{Name: "receiveIntent", Src: []string{"STANDBY"}, Dst: "INTENT_CONFIRMED"},
+
+	// {Name: "unknownLocation", Src: []string{"INTENT_CONFIRMED"}, Dst: "UNKNOWN_LOCATION"},
+	{Name: "getConfusedLocation", Src: []string{"STANDBY", "INTENT_CONFIRMED"}, Dst: "UNSURE_LOCATION"},
+	{Name: "responeResult", Src: []string{"INTENT_CONFIRMED", "UNSURE_LOCATION", "LOCATION_CONFIRMED"}, Dst: "STANDBY"},
+
+	{Name: "openSettings", Src: []string{"STANDBY", "INTENT_CONFIRMED", "UNSURE_LOCATION", "SETTINGS", "SETTING_HOME", "SETTING_WORK"}, Dst: "SETTINGS"},
+	{Name: "askHome", Src: []string{"SETTINGS", "SETTING_WORK"}, Dst: "SETTING_HOME"},
+	{Name: "askWork", Src: []string{"SETTINGS", "SETTING_HOME"}, Dst: "SETTING_WORK"},
+
+	{Name: "startSubmission", Src: []string{"STANDBY", "INTENT_CONFIRMED", "UNSURE_LOCATION"}, Dst: "SUBMIT_NAME"},
+	{Name: "submitName", Src: []string{"SUBMIT_NAME"}, Dst: "SUBMIT_LOCATION"},
+	{Name: "submitLocation", Src: []string{"SUBMIT_LOCATION"}, Dst: "SUBMIT_PLUG"},
+	{Name: "submitPlug", Src: []string{"SUBMIT_PLUG"}, Dst: "SUBMIT_TIME_LIMIT"},
+	{Name: "submitTimeLimit", Src: []string{"SUBMIT_TIME_LIMIT"}, Dst: "SUBMIT_RATING"},
+	{Name: "submitted", Src: []string{"SUBMIT_RATING"}, Dst: "STANDBY"},
+
+	{Name: "cancel", Src: []string{"INTENT_CONFIRMED", "UNKNOWN_LOCATION", "UNSURE_LOCATION", "SETTINGS", "SETTING_HOME", "SETTING_WORK",
+		"SUBMIT_NAME", "SUBMIT_LOCATION", "SUBMIT_PLUG", "SUBMIT_TIME_LIMIT", "SUBMIT_RATING"}, Dst: "STANDBY"},
+}
 
-		{Name: "cancel", Src: []string{"INTENT_CONFIRMED", "UNKNOWN_LOCATION", "UNSURE_LOCATION"}, Dst: "STANDBY"},
-	}, fsm.Callbacks{
+// attachFSM rebuilds the conversation state machine of a user starting from
+// user.State, so a user loaded from a SessionStore resumes where it left off.
+func (user *User) attachFSM() {
+	if user.State == "" {
+		user.State = "STANDBY"
+	}
+	user.FSM = fsm.NewFSM(user.State, conversationEvents, fsm.Callbacks{
 		"after_event": func(event *fsm.Event) {
 			user.State = event.Dst
 		},
 	})
-	return user
 }
 
 func commandHandler(ctx context.Context, user *User, payload string, a ambassador.Ambassador) (err error) {
@@ -405,22 +633,83 @@ func commandHandler(ctx context.Context, user *User, payload string, a ambassado
 		switch payloadItems[0] {
 		case "FIND_CAFE_GEOCODING":
 			user.FSM.Event("responeResult")
-			latlng := strings.Split(payloadItems[1], ",")
-			if len(latlng) != 2 {
-				log.Errorf(ctx, "FIND_CAFE postback arguments error: %+v", latlng)
+			q, perr := parseCafeQuery(payloadItems[1:])
+			if perr != nil {
+				log.Errorf(ctx, "FIND_CAFE postback arguments error: %s", perr)
 				err = a.SendText(user.Id, "查詢錯誤")
 			} else {
-				lat, err := strconv.ParseFloat(latlng[0], 64)
-				if err != nil {
-					return err
-				}
-				long, err := strconv.ParseFloat(latlng[1], 64)
-				if err != nil {
-					return err
-				}
-				filteredCafes := findCafeByGeocoding(ctx, lat, long, 7)
-				err = sendCafeMessages(a, filteredCafes, user.Id)
+				err = searchNearby(ctx, a, user, user.applyPreferences(q))
+			}
+		case "FIND_CAFE_PAGE":
+			user.FSM.Event("responeResult")
+			q, perr := parseCafeQuery(payloadItems[1:])
+			if perr != nil {
+				log.Errorf(ctx, "FIND_CAFE_PAGE postback arguments error: %s", perr)
+				err = a.SendText(user.Id, "查詢錯誤")
+			} else {
+				err = replyCafesNearby(ctx, a, user.Id, user.applyPreferences(q))
+			}
+		case "FIND_CAFE_ROUTE":
+			user.FSM.Event("responeResult")
+			q, perr := parseRouteQuery(payloadItems[1:])
+			if perr != nil {
+				log.Errorf(ctx, "FIND_CAFE_ROUTE postback arguments error: %s", perr)
+				err = a.SendText(user.Id, "查詢錯誤")
+			} else {
+				err = replyCafesAlongRoute(ctx, a, user.Id, user.applyRoutePreferences(q))
+			}
+		case "FIND_CAFE_LINE":
+			user.FSM.Event("responeResult")
+			q, perr := parseLineQuery(payloadItems[1:])
+			if perr != nil {
+				log.Errorf(ctx, "FIND_CAFE_LINE postback arguments error: %s", perr)
+				err = a.SendText(user.Id, "查詢錯誤")
+			} else {
+				err = replyCafesAlongLine(ctx, a, user.Id, user.applyLinePreferences(q))
+			}
+		case "CAFE_DETAIL":
+			user.FSM.Event("responeResult")
+			if len(payloadItems) == 2 && payloadItems[1] != "" {
+				err = replyCafeDetail(ctx, a, user, payloadItems[1])
+			}
+		case "CAFE_DIRECTIONS":
+			user.FSM.Event("responeResult")
+			if len(payloadItems) == 2 && payloadItems[1] != "" {
+				err = replyCafeDirections(ctx, a, user, payloadItems[1])
+			}
+		case "SIMILAR_TO":
+			user.FSM.Event("responeResult")
+			if len(payloadItems) == 2 && payloadItems[1] != "" {
+				err = replySimilarCafes(ctx, a, user, payloadItems[1])
+			}
+		case "FAVORITE_ADD":
+			user.FSM.Event("responeResult")
+			if len(payloadItems) == 2 && payloadItems[1] != "" {
+				err = addFavorite(ctx, a, user, payloadItems[1])
+			}
+		case "FAVORITE_REMOVE":
+			user.FSM.Event("responeResult")
+			if len(payloadItems) == 2 && payloadItems[1] != "" {
+				err = removeFavorite(ctx, a, user, payloadItems[1])
 			}
+		case "RATE":
+			user.FSM.Event("responeResult")
+			if len(payloadItems) >= 2 && payloadItems[1] != "" {
+				err = rateCafe(ctx, a, user, payloadItems[1:])
+			}
+		case "FAVORITE_LIST":
+			user.FSM.Event("responeResult")
+			offset := 0
+			if len(payloadItems) == 2 {
+				offset, _ = strconv.Atoi(payloadItems[1])
+			}
+			err = replyFavorites(ctx, a, user, offset)
+		case "SETTINGS", "SETTINGS_FILTER", "SETTINGS_PROFILE", "SETTINGS_PAGE_SIZE", "SETTINGS_PLACE", "SETTINGS_RESET":
+			_, err = settingsCommand(ctx, user, payload, a)
+		case "HISTORY_CLEAR":
+			user.FSM.Event("responeResult")
+			user.History = nil
+			err = a.SendText(user.Id, "已清除查詢紀錄")
 		case "FIND_CAFE_LOCATION":
 			if len(payloadItems) == 2 && payloadItems[1] != "" {
 				var places []Place
@@ -430,29 +719,30 @@ func commandHandler(ctx context.Context, user *User, payload string, a ambassado
 					err = a.SendText(user.Id, "無法辨識的地點")
 				} else if len(places) == 1 {
 					user.FSM.Event("responeResult")
-					var filteredCafes []Cafe
-					lat := places[0].Geometry.Location.Lat
-					long := places[0].Geometry.Location.Lng
-					filteredCafes = findCafeByGeocoding(ctx, lat, long, 7)
-					err = sendCafeMessages(a, filteredCafes, user.Id)
+					user.LastText = payloadItems[1]
+					err = searchNearby(ctx, a, user, placeQuery(places[0], user))
 				} else {
 					user.FSM.Event("getConfusedLocation")
-					err = askLocationConfirm(a, places, user.Id)
+					user.LastText = payloadItems[1]
+					err = askLocationConfirm(a, places, user)
 				}
 			}
 		case "FIND_CAFE":
 			user.FSM.Event("receiveIntent")
+			user.Filter = nil
+			user.Profile = ""
 			text := "想去哪喝呢？"
 			answers := []map[string]string{
 				map[string]string{
 					"content_type": "location",
 				},
-				map[string]string{
-					"content_type": "text",
-					"title":        "取消",
-					"payload":      "CANCEL",
-				},
 			}
+			answers = append(answers, savedPlaceReplies(user)...)
+			answers = append(answers, map[string]string{
+				"content_type": "text",
+				"title":        "取消",
+				"payload":      "CANCEL",
+			})
 			err = a.AskQuestion(user.Id, text, answers)
 		case "CANCEL":
 			user.FSM.Event("cancel")
@@ -470,7 +760,7 @@ func commandHandler(ctx context.Context, user *User, payload string, a ambassado
 	return
 }
 
-func standbyHandler(ctx context.Context, user *User, msg ambassador.Message, a ambassador.Ambassador) (err error) {
+func standbyHandler(ctx context.Context, cfg *Config, user *User, msg ambassador.Message, a ambassador.Ambassador) (err error) {
 	switch msgContent := msg.Content.(type) {
 	case *ambassador.TextContent:
 		q := strings.ToLower(msgContent.Text)
@@ -482,17 +772,19 @@ func standbyHandler(ctx context.Context, user *User, msg ambassador.Message, a a
 				log.Errorf(ctx, err.Error())
 			}
 		default:
-			err = contextAnalysis(ctx, user, q, a)
+			err = contextAnalysis(ctx, cfg, user, q, a)
 		}
 	case *ambassador.CommandContent:
 		err = commandHandler(ctx, user, msgContent.Payload, a)
 	case *ambassador.LocationContent:
+		user.LastText = "標記的位置"
 		text := "尋找這個地點周圍的咖啡店?"
+		q := user.newQuery(msgContent.Lat, msgContent.Lon)
 		quickReplies := []map[string]string{
 			map[string]string{
 				"content_type": "text",
 				"title":        "是",
-				"payload":      fmt.Sprintf("FIND_CAFE_GEOCODING:%f,%f", msgContent.Lat, msgContent.Lon),
+				"payload":      q.payload("FIND_CAFE_GEOCODING"),
 			},
 			map[string]string{
 				"content_type": "text",
@@ -510,28 +802,31 @@ func intentConfirmHandler(ctx context.Context, user *User, msg ambassador.Messag
 	switch msgContent := msg.Content.(type) {
 	case *ambassador.TextContent:
 		q := strings.ToLower(msgContent.Text)
+		user.Filter = user.Filter.merge(filterFromText(q))
+		if p := profileFromText(q); p != "" {
+			user.Profile = p
+		}
 		var places []Place
 		places, err = resolveGeocoding(ctx, q)
+		if len(places) > 0 {
+			user.LastText = msgContent.Text
+		}
 		if len(places) == 0 {
 			user.FSM.Event("responeResult")
 			err = a.SendText(user.Id, "無法辨識的地點")
 		} else if len(places) == 1 {
-			var filteredCafes []Cafe
 			user.FSM.Event("responeResult")
-			lat := places[0].Geometry.Location.Lat
-			long := places[0].Geometry.Location.Lng
-			filteredCafes = findCafeByGeocoding(ctx, lat, long, 7)
-			err = sendCafeMessages(a, filteredCafes, user.Id)
+			err = searchNearby(ctx, a, user, placeQuery(places[0], user))
 		} else {
 			user.FSM.Event("getConfusedLocation")
-			err = askLocationConfirm(a, places, user.Id)
+			err = askLocationConfirm(a, places, user)
 		}
 	case *ambassador.CommandContent:
 		err = commandHandler(ctx, user, msgContent.Payload, a)
 	case *ambassador.LocationContent:
 		user.FSM.Event("responeResult")
-		filteredCafes := findCafeByGeocoding(ctx, msgContent.Lat, msgContent.Lon, 7)
-		err = sendCafeMessages(a, filteredCafes, user.Id)
+		user.LastText = "標記的位置"
+		err = searchNearby(ctx, a, user, user.newQuery(msgContent.Lat, msgContent.Lon))
 	}
 	return
 }
@@ -540,32 +835,36 @@ func unsureLocationHandler(ctx context.Context, user *User, msg ambassador.Messa
 	switch msgContent := msg.Content.(type) {
 	case *ambassador.TextContent:
 		q := strings.ToLower(msgContent.Text)
+		user.Filter = user.Filter.merge(filterFromText(q))
+		if p := profileFromText(q); p != "" {
+			user.Profile = p
+		}
 		var places []Place
 		places, err = resolveGeocoding(ctx, q)
+		if len(places) > 0 {
+			user.LastText = msgContent.Text
+		}
 		if len(places) == 0 {
 			user.FSM.Event("responeResult")
 			err = a.SendText(user.Id, "無法辨識的地點")
 		} else if len(places) == 1 {
-			var filteredCafes []Cafe
 			user.FSM.Event("responeResult")
-			lat := places[0].Geometry.Location.Lat
-			long := places[0].Geometry.Location.Lng
-			filteredCafes = findCafeByGeocoding(ctx, lat, long, 7)
-			err = sendCafeMessages(a, filteredCafes, user.Id)
+			err = searchNearby(ctx, a, user, placeQuery(places[0], user))
 		} else {
 			user.FSM.Event("getConfusedLocation")
-			err = askLocationConfirm(a, places, user.Id)
+			err = askLocationConfirm(a, places, user)
 		}
 	case *ambassador.CommandContent:
 		err = commandHandler(ctx, user, msgContent.Payload, a)
 	case *ambassador.LocationContent:
 		user.FSM.Event("receiveGeocoding")
+		user.LastText = "標記的位置"
 		text := "尋找這個地點周圍的咖啡店?"
 		quickReplies := []map[string]string{
 			map[string]string{
 				"content_type": "text",
 				"title":        "是",
-				"payload":      fmt.Sprintf("FIND_CAFE_GEOCODING:%f,%f", msgContent.Lat, msgContent.Lon),
+				"payload":      user.newQuery(msgContent.Lat, msgContent.Lon).payload("FIND_CAFE_GEOCODING"),
 			},
 			map[string]string{
 				"content_type": "text",
@@ -579,15 +878,72 @@ func unsureLocationHandler(ctx context.Context, user *User, msg ambassador.Messa
 	return
 }
 
-func fbCBPostHandler(w http.ResponseWriter, r *http.Request) {
+// handleMessage applies a message to the conversation of its sender. Messages
+// of the same sender are processed one at a time.
+func handleMessage(ctx context.Context, cfg *Config, msg ambassador.Message, a ambassador.Ambassador) {
+	senderId := msg.SenderId
+
+	userLocks.Lock(senderId)
+	defer userLocks.Unlock(senderId)
+
+	// a session that can not be read is not replaced by a new one, which
+	// would lose the preferences and history of the user
+	user, err := sessions.Get(ctx, senderId)
+	if err != nil {
+		log.Errorf(ctx, "can not load session of user %s: %s", senderId, err.Error())
+		a.SendText(senderId, "讀取你的資料時發生錯誤，請稍後再試")
+		return
+	}
+	if user == nil {
+		user = newUser(senderId)
+	}
+	now := time.Now()
+	if user.expireIfIdle(now, time.Duration(cfg.SessionIdleTimeout)) {
+		log.Infof(ctx, "User %s has been idle since %s, back to STANDBY", user.Id, user.LastActive)
+	}
+	user.LastActive = now
+	log.Debugf(ctx, "User %s is at state: %s", user.Id, user.State)
+
+	switch user.State {
+	case "STANDBY":
+		err = standbyHandler(ctx, cfg, user, msg, a)
+	case "INTENT_CONFIRMED":
+		err = intentConfirmHandler(ctx, user, msg, a)
+	case "UNSURE_LOCATION":
+		err = unsureLocationHandler(ctx, user, msg, a)
+	case "SETTINGS":
+		err = settingsHandler(ctx, user, msg, a)
+	case "SETTING_HOME", "SETTING_WORK":
+		err = settingPlaceHandler(ctx, user, msg, a)
+	case "SUBMIT_NAME", "SUBMIT_LOCATION", "SUBMIT_PLUG", "SUBMIT_TIME_LIMIT", "SUBMIT_RATING":
+		err = submissionHandler(ctx, cfg, user, msg, a)
+	default:
+	}
+
+	if err != nil {
+		log.Errorf(ctx, "an error occurs on message delivery: %s", err.Error())
+		// a.SendText(senderId, "我好像壞掉了")
+	}
+
+	if err := sessions.Put(ctx, user); err != nil {
+		log.Errorf(ctx, "can not save session of user %s: %s", user.Id, err.Error())
+	}
+}
+
+func fbCBPostHandler(cfg *Config, w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 	ctx := appengine.NewContext(r)
-	client := urlfetch.Client(ctx)
-	a := ambassador.NewFBAmbassador(PAGE_TOKEN, client)
+	a := newAmbassador(ctx, cfg)
 
 	buf := &bytes.Buffer{}
 	_, _ = io.Copy(buf, r.Body)
 
+	if !validSignature(r.Header, buf.Bytes(), cfg.AppSecret) {
+		log.Warningf(ctx, "reject a callback with invalid signature")
+		http.Error(w, "Invalid Signature", http.StatusForbidden)
+		return
+	}
+
 	log.Infof(ctx, "Incoming message: %s", buf.String())
 
 	messages, err := a.Translate(buf)
@@ -597,45 +953,21 @@ func fbCBPostHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	for _, msg := range messages {
-		senderId := msg.SenderId
-
-		user, ok := users[senderId]
-		if !ok {
-			user = newUser(senderId)
-			users[senderId] = user
-		}
-		log.Debugf(ctx, "User %s is at state: %s", user.Id, user.State)
-
-		var err error
-
-		switch user.State {
-		case "STANDBY":
-			err = standbyHandler(ctx, user, msg, a)
-		case "INTENT_CONFIRMED":
-			err = intentConfirmHandler(ctx, user, msg, a)
-		case "UNSURE_LOCATION":
-			err = unsureLocationHandler(ctx, user, msg, a)
-		default:
-		}
-
-		if err != nil {
-			log.Errorf(ctx, "an error occurs on message delivery: %s", err.Error())
-			// a.SendText(senderId, "我好像壞掉了")
-		}
+		handleMessage(ctx, cfg, msg, a)
 	}
 	fmt.Fprint(w, "")
 }
 
-func fbCBHandler(w http.ResponseWriter, r *http.Request) {
+func fbCBHandler(cfg *Config, w http.ResponseWriter, r *http.Request) {
 	if r.Method == "GET" {
-		if r.FormValue("hub.verify_token") == BOT_TOKEN {
+		if r.FormValue("hub.verify_token") == cfg.BotToken {
 			challenge := r.FormValue("hub.challenge")
 			fmt.Fprint(w, challenge)
 		} else {
 			http.Error(w, "Invalid Token", http.StatusForbidden)
 		}
 	} else if r.Method == "POST" {
-		fbCBPostHandler(w, r)
+		fbCBPostHandler(cfg, w, r)
 	} else {
 		http.Error(w, "", http.StatusMethodNotAllowed)
 	}
@@ -0,0 +1,293 @@
+package cafehunter
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/lemonlatte/ambassador"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/aetest"
+)
+
+const TEST_APP_SECRET = "test-app-secret"
+
+// testConfig is a valid configuration keeping everything in memory.
+func testConfig() *Config {
+	cfg := defaultConfig()
+	cfg.BotToken = "test-bot-token"
+	cfg.PageToken = "test-page-token"
+	cfg.AppSecret = TEST_APP_SECRET
+	cfg.LuisAppID = "test-luis-app"
+	cfg.LuisAppKey = "test-luis-key"
+	cfg.SessionStore = "memory"
+	cfg.CafeDataFile = "data/cafes.sample.json"
+	return cfg
+}
+
+// testMessage is a message as the fake ambassador reads it from a callback.
+type testMessage struct {
+	Sender  string  `json:"sender"`
+	Text    string  `json:"text,omitempty"`
+	Payload string  `json:"payload,omitempty"`
+	Lat     float64 `json:"lat,omitempty"`
+	Lon     float64 `json:"lon,omitempty"`
+}
+
+// fakeAmbassador records what the bot sends and tells whether replies to
+// the same user ever overlapped, which the sender lock must prevent.
+type fakeAmbassador struct {
+	mu       sync.Mutex
+	sent     map[string][]string
+	replies  map[string][]map[string]string
+	active   map[string]int
+	overlaps int
+}
+
+func newFakeAmbassador() *fakeAmbassador {
+	return &fakeAmbassador{
+		sent:    map[string][]string{},
+		replies: map[string][]map[string]string{},
+		active:  map[string]int{},
+	}
+}
+
+func (a *fakeAmbassador) Translate(r io.Reader) ([]ambassador.Message, error) {
+	in := []testMessage{}
+	if err := json.NewDecoder(r).Decode(&in); err != nil {
+		return nil, err
+	}
+
+	messages := []ambassador.Message{}
+	for _, m := range in {
+		msg := ambassador.Message{SenderId: m.Sender}
+		switch {
+		case m.Payload != "":
+			msg.Content = &ambassador.CommandContent{Payload: m.Payload}
+		case m.Text != "":
+			msg.Content = &ambassador.TextContent{Text: m.Text}
+		default:
+			msg.Content = &ambassador.LocationContent{Lat: m.Lat, Lon: m.Lon}
+		}
+		messages = append(messages, msg)
+	}
+	return messages, nil
+}
+
+func (a *fakeAmbassador) send(to, text string) error {
+	a.mu.Lock()
+	a.active[to]++
+	if a.active[to] > 1 {
+		a.overlaps++
+	}
+	a.mu.Unlock()
+
+	// leave time for another message of the same user to sneak in
+	time.Sleep(time.Millisecond)
+
+	a.mu.Lock()
+	a.active[to]--
+	a.sent[to] = append(a.sent[to], text)
+	a.mu.Unlock()
+	return nil
+}
+
+func (a *fakeAmbassador) SendText(to, text string) error { return a.send(to, text) }
+
+// SendTemplate records the elements of a template as JSON.
+func (a *fakeAmbassador) SendTemplate(to string, payload interface{}) error {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return a.send(to, string(b))
+}
+
+// AskQuestion also keeps the quick replies of the last question.
+func (a *fakeAmbassador) AskQuestion(to, text string, replies interface{}) error {
+	a.mu.Lock()
+	a.replies[to], _ = replies.([]map[string]string)
+	a.mu.Unlock()
+	return a.send(to, text)
+}
+
+// lastReplies returns the quick replies of the last question and forgets
+// them.
+func (a *fakeAmbassador) lastReplies(to string) []map[string]string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	replies := a.replies[to]
+	delete(a.replies, to)
+	return replies
+}
+
+func (a *fakeAmbassador) texts(to string) []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]string{}, a.sent[to]...)
+}
+
+// useFakeAmbassador makes the handlers talk to a, until the returned
+// function restores the Messenger client.
+func useFakeAmbassador(a ambassador.Ambassador) func() {
+	saved := newAmbassador
+	newAmbassador = func(ctx context.Context, cfg *Config) ambassador.Ambassador { return a }
+	return func() { newAmbassador = saved }
+}
+
+// useMemorySessions starts the test with no session, until the returned
+// function restores the session store.
+func useMemorySessions() (*memorySessionStore, func()) {
+	saved := sessions
+	s := newMemorySessionStore()
+	sessions = s
+	return s, func() { sessions = saved }
+}
+
+func sign(body []byte, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// newCallback returns a webhook POST of messages signed with secret.
+func newCallback(t *testing.T, inst aetest.Instance, messages []testMessage, secret string) *http.Request {
+	body, err := json.Marshal(messages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := inst.NewRequest("POST", "/fbCallback", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("X-Hub-Signature-256", sign(body, secret))
+	return r
+}
+
+func TestConcurrentCallbacks(t *testing.T) {
+	inst, err := aetest.NewInstance(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inst.Close()
+
+	a := newFakeAmbassador()
+	defer useFakeAmbassador(a)()
+	store, restore := useMemorySessions()
+	defer restore()
+	cfg := testConfig()
+
+	const USERS, MESSAGES = 4, 10
+	requests := []*http.Request{}
+	for i := 0; i < MESSAGES; i++ {
+		for u := 0; u < USERS; u++ {
+			m := testMessage{Sender: fmt.Sprintf("user-%d", u), Lat: 25.04 + float64(i)/1000, Lon: 121.5}
+			requests = append(requests, newCallback(t, inst, []testMessage{m}, TEST_APP_SECRET))
+		}
+	}
+
+	var wg sync.WaitGroup
+	codes := make([]int, len(requests))
+	for i, r := range requests {
+		wg.Add(1)
+		go func(i int, r *http.Request) {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			fbCBPostHandler(cfg, w, r)
+			codes[i] = w.Code
+		}(i, r)
+	}
+	wg.Wait()
+
+	for i, code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("callback %d: got status %d, want %d", i, code, http.StatusOK)
+		}
+	}
+	if a.overlaps > 0 {
+		t.Errorf("replies to the same user overlapped %d times", a.overlaps)
+	}
+	for u := 0; u < USERS; u++ {
+		id := fmt.Sprintf("user-%d", u)
+		if n := len(a.texts(id)); n != MESSAGES {
+			t.Errorf("%s got %d replies, want %d", id, n, MESSAGES)
+		}
+		user, err := store.Get(context.Background(), id)
+		if err != nil || user == nil {
+			t.Fatalf("session of %s not saved: %v", id, err)
+		}
+		if user.State != "STANDBY" || user.LastText != "標記的位置" {
+			t.Errorf("session of %s is %q with %q", id, user.State, user.LastText)
+		}
+	}
+}
+
+// useSampleCafes serves the cafes of the sample fixture with no rating,
+// until the returned function restores the cafe and rating stores.
+func useSampleCafes(t *testing.T) func() {
+	f, err := os.Open(SAMPLE_CAFES)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	cafes, _, err := decodeNomadCafes(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	savedRepo, savedRatings := cafeRepo, ratings
+	cafeRepo, ratings = newMemoryCafeRepository(cafes), newMemoryRatingStore()
+	return func() { cafeRepo, ratings = savedRepo, savedRatings }
+}
+
+func TestCafeSubtitle(t *testing.T) {
+	now := time.Date(2026, 10, 14, 15, 0, 0, 0, taipei)
+	cafe := Cafe{
+		Name:     "很長名字的咖啡店",
+		Address:  "100台北市中正區重慶南路一段122號地下一樓之三（請由側門進入，電梯旁邊）",
+		OpenTime: "每日 08:00-12:00, 13:00-17:00, 18:00-23:00",
+		Distance: 350,
+		Tasty:    4.5,
+		Wifi:     4,
+		Quiet:    3,
+		Reviews:  ratingSummary{Count: 3, Wifi: 5, Quiet: 4, Tasty: 4, Price: 4},
+	}
+
+	subtitle := cafeSubtitle(cafe, now)
+	if n := utf8.RuneCountInString(subtitle); n > SUBTITLE_LIMIT {
+		t.Errorf("got %d characters, want at most %d: %q", n, SUBTITLE_LIMIT, subtitle)
+	}
+	lines := strings.Split(subtitle, "\n")
+	if lines[0] != walkingText(cafe.Distance) {
+		t.Errorf("got first line %q, want the distance", lines[0])
+	}
+	if want := "好喝 4.5｜Wifi 4.0｜安靜 3.0｜便宜 -"; lines[1] != want {
+		t.Errorf("got ratings %q, want %q", lines[1], want)
+	}
+	if len(lines) != 3 || !strings.HasPrefix(lines[2], "網友 4.2 (3 人)｜今日 08:00-12:00") || !strings.HasSuffix(lines[2], "…") {
+		t.Errorf("got %q, want the reviews and hours cut short without the address", lines[2:])
+	}
+
+	// a short address fits, and cafes found without a search start with it
+	cafe.Address, cafe.Distance, cafe.OpenTime = "台北市大安區", 0, ""
+	want := "好喝 4.5｜Wifi 4.0｜安靜 3.0｜便宜 -\n網友 4.2 (3 人)｜營業時間未提供\n台北市大安區"
+	if got := cafeSubtitle(cafe, now); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if got := fitLines([]string{strings.Repeat("長", 100)}, SUBTITLE_LIMIT); utf8.RuneCountInString(got) != SUBTITLE_LIMIT {
+		t.Errorf("a long first line was cut to %d characters", utf8.RuneCountInString(got))
+	}
+}
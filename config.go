@@ -0,0 +1,267 @@
+package cafehunter
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the secrets and settings of the bot. It is read from an
+// optional JSON file and then from environment variables, which take
+// precedence, so secrets can be set through env_variables in app.yaml.
+type Config struct {
+	BotToken          string `json:"botToken"`
+	PageToken         string `json:"pageToken"`
+	AppSecret         string `json:"appSecret"`
+	GoogleMapsAPIKey  string `json:"googleMapsApiKey"`
+	FirebaseURL       string `json:"firebaseUrl"`
+	FirebaseAuthToken string `json:"firebaseAuthToken"`
+
+	LuisURL    string `json:"luisUrl"`
+	LuisAppID  string `json:"luisAppId"`
+	LuisAppKey string `json:"luisAppKey"`
+
+	// CafeDataFile is a cafenomad JSON dump served from memory instead of
+	// querying Firebase.
+	CafeDataFile string `json:"cafeDataFile"`
+
+	// CafeNomadURL is where /tasks/importCafes fetches cafes from, a URL of
+	// the cafenomad API or a local file in its format.
+	CafeNomadURL string `json:"cafeNomadUrl"`
+
+	// AdminToken is the bearer token of the /admin API, which is closed
+	// while it is empty.
+	AdminToken string `json:"adminToken"`
+
+	// GazetteerFile lists the districts and landmarks resolved without
+	// Google Maps.
+	GazetteerFile string `json:"gazetteerFile"`
+
+	// MetroFile lists the metro lines and their stations, which are matched
+	// before any other place.
+	MetroFile string `json:"metroFile"`
+
+	// SearchRadius is how far in meters from the asked point cafes are
+	// searched first. The radius is doubled up to MaxSearchRadius until at
+	// least MinSearchResults cafes are found.
+	SearchRadius     float64 `json:"searchRadius"`
+	MaxSearchRadius  float64 `json:"maxSearchRadius"`
+	MinSearchResults int     `json:"minSearchResults"`
+
+	// Place searches are cached in memory for GeocodeCacheTTL, at most
+	// GeocodeCacheSize of them, and also in Firebase when GeocodeCacheStore
+	// is "firebase".
+	GeocodeCacheTTL   Duration `json:"geocodeCacheTTL"`
+	GeocodeCacheSize  int      `json:"geocodeCacheSize"`
+	GeocodeCacheStore string   `json:"geocodeCacheStore"`
+
+	// SessionStore is either "firebase" or "memory".
+	SessionStore       string   `json:"sessionStore"`
+	SessionIdleTimeout Duration `json:"sessionIdleTimeout"`
+}
+
+// Duration is a time.Duration written as a string such as "10m" in JSON.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+const DEFAULT_CONFIG_FILE = "config.json"
+
+var (
+	config    *Config
+	configErr error
+)
+
+func defaultConfig() *Config {
+	return &Config{
+		FirebaseURL:        "https://cafe-hunter.firebaseio.com",
+		LuisURL:            "api.projectoxford.ai",
+		CafeNomadURL:       "https://cafenomad.tw/api/v1.2/cafes",
+		GazetteerFile:      "data/gazetteer.json",
+		MetroFile:          "data/metro.json",
+		SearchRadius:       500,
+		MaxSearchRadius:    4000,
+		MinSearchResults:   3,
+		GeocodeCacheTTL:    Duration(24 * time.Hour),
+		GeocodeCacheSize:   1000,
+		SessionStore:       "firebase",
+		SessionIdleTimeout: Duration(10 * time.Minute),
+	}
+}
+
+// loadConfig reads the file named by CAFEHUNTER_CONFIG, or config.json when
+// it exists, applies environment variables and validates the result. The
+// returned config is never nil so callers can fall back on its defaults.
+func loadConfig() (*Config, error) {
+	cfg := defaultConfig()
+
+	path := os.Getenv("CAFEHUNTER_CONFIG")
+	if path == "" {
+		path = DEFAULT_CONFIG_FILE
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			path = ""
+		}
+	}
+	if path != "" {
+		if err := cfg.loadFile(path); err != nil {
+			return cfg, fmt.Errorf("can not read config file %s: %s", path, err)
+		}
+	}
+
+	if err := cfg.loadEnv(); err != nil {
+		return cfg, err
+	}
+	return cfg, cfg.Validate()
+}
+
+func (cfg *Config) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewDecoder(f).Decode(cfg)
+}
+
+func (cfg *Config) loadEnv() error {
+	for name, field := range map[string]*string{
+		"BOT_TOKEN":           &cfg.BotToken,
+		"PAGE_TOKEN":          &cfg.PageToken,
+		"APP_SECRET":          &cfg.AppSecret,
+		"GOOG_MAP_APIKEY":     &cfg.GoogleMapsAPIKey,
+		"FIREBASE_URL":        &cfg.FirebaseURL,
+		"FIREBASE_AUTH_TOKEN": &cfg.FirebaseAuthToken,
+		"LUIS_URL":            &cfg.LuisURL,
+		"LUIS_APP_ID":         &cfg.LuisAppID,
+		"LUIS_APP_KEY":        &cfg.LuisAppKey,
+		"CAFE_DATA_FILE":      &cfg.CafeDataFile,
+		"CAFENOMAD_URL":       &cfg.CafeNomadURL,
+		"ADMIN_TOKEN":         &cfg.AdminToken,
+		"GAZETTEER_FILE":      &cfg.GazetteerFile,
+		"METRO_FILE":          &cfg.MetroFile,
+		"GEOCODE_CACHE_STORE": &cfg.GeocodeCacheStore,
+		"SESSION_STORE":       &cfg.SessionStore,
+	} {
+		if v := os.Getenv(name); v != "" {
+			*field = v
+		}
+	}
+
+	for name, field := range map[string]*float64{
+		"SEARCH_RADIUS":     &cfg.SearchRadius,
+		"MAX_SEARCH_RADIUS": &cfg.MaxSearchRadius,
+	} {
+		if v := os.Getenv(name); v != "" {
+			r, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return fmt.Errorf("invalid %s %q: %s", name, v, err)
+			}
+			*field = r
+		}
+	}
+
+	for name, field := range map[string]*int{
+		"MIN_SEARCH_RESULTS": &cfg.MinSearchResults,
+		"GEOCODE_CACHE_SIZE": &cfg.GeocodeCacheSize,
+	} {
+		if v := os.Getenv(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("invalid %s %q: %s", name, v, err)
+			}
+			*field = n
+		}
+	}
+
+	for name, field := range map[string]*Duration{
+		"GEOCODE_CACHE_TTL":    &cfg.GeocodeCacheTTL,
+		"SESSION_IDLE_TIMEOUT": &cfg.SessionIdleTimeout,
+	} {
+		if v := os.Getenv(name); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return fmt.Errorf("invalid %s %q: %s", name, v, err)
+			}
+			*field = Duration(d)
+		}
+	}
+	return nil
+}
+
+// Validate reports every missing secret at once instead of letting the API
+// calls that need them fail one by one.
+func (cfg *Config) Validate() error {
+	missing := []string{}
+	for _, s := range []struct {
+		name  string
+		value string
+	}{
+		{"BOT_TOKEN", cfg.BotToken},
+		{"PAGE_TOKEN", cfg.PageToken},
+		{"APP_SECRET", cfg.AppSecret},
+		{"LUIS_URL", cfg.LuisURL},
+		{"LUIS_APP_ID", cfg.LuisAppID},
+		{"LUIS_APP_KEY", cfg.LuisAppKey},
+	} {
+		if s.value == "" {
+			missing = append(missing, s.name)
+		}
+	}
+	if cfg.usesFirebase() {
+		if cfg.FirebaseURL == "" {
+			missing = append(missing, "FIREBASE_URL")
+		}
+		if cfg.FirebaseAuthToken == "" {
+			missing = append(missing, "FIREBASE_AUTH_TOKEN")
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing required configuration: %s", strings.Join(missing, ", "))
+	}
+
+	switch cfg.SessionStore {
+	case "firebase", "memory":
+	default:
+		return fmt.Errorf("unknown SESSION_STORE %q", cfg.SessionStore)
+	}
+
+	if cfg.SearchRadius <= 0 {
+		return fmt.Errorf("SEARCH_RADIUS must be positive")
+	}
+	if cfg.MaxSearchRadius < cfg.SearchRadius {
+		return fmt.Errorf("MAX_SEARCH_RADIUS must not be less than SEARCH_RADIUS")
+	}
+
+	switch cfg.GeocodeCacheStore {
+	case "", "firebase":
+	default:
+		return fmt.Errorf("unknown GEOCODE_CACHE_STORE %q", cfg.GeocodeCacheStore)
+	}
+	if cfg.GeocodeCacheTTL <= 0 || cfg.GeocodeCacheSize <= 0 {
+		return fmt.Errorf("GEOCODE_CACHE_TTL and GEOCODE_CACHE_SIZE must be positive")
+	}
+
+	if cfg.SessionIdleTimeout <= 0 {
+		return fmt.Errorf("SESSION_IDLE_TIMEOUT must be positive")
+	}
+	return nil
+}
+
+// usesFirebase reports whether any store is backed by Firebase.
+func (cfg *Config) usesFirebase() bool {
+	return cfg.SessionStore == "firebase" || cfg.CafeDataFile == "" || cfg.GeocodeCacheStore == "firebase"
+}
@@ -0,0 +1,147 @@
+package cafehunter
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/lemonlatte/ambassador"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/log"
+)
+
+// ratingText shows a rating as stars with its value, e.g. "🌟🌟🌟🌟½ (4.5)".
+func ratingText(rating float64) string {
+	if rating <= 0 {
+		return "尚無評分"
+	}
+	return fmt.Sprintf("%s (%.1f)", pointToStar(rating), rating)
+}
+
+// answerText translates the yes/maybe/no answers of cafenomad.
+func answerText(answer, yes, maybe, no string) string {
+	switch answer {
+	case "yes":
+		return yes
+	case "maybe":
+		return maybe
+	case "no":
+		return no
+	}
+	return "不確定"
+}
+
+// withReviewText follows an imported rating with the average users gave,
+// e.g. "🌟🌟🌟🌟 (4.0)｜網友 4.5".
+func withReviewText(rating, review float64) string {
+	if review <= 0 {
+		return ratingText(rating)
+	}
+	return fmt.Sprintf("%s｜網友 %.1f", ratingText(rating), review)
+}
+
+// cafeDetailText lists everything known about a cafe.
+func cafeDetailText(c Cafe) string {
+	lines := []string{
+		c.Name,
+		fmt.Sprintf("好喝: %s", withReviewText(c.Tasty, c.Reviews.Tasty)),
+		fmt.Sprintf("Wifi: %s", withReviewText(c.Wifi, c.Reviews.Wifi)),
+		fmt.Sprintf("座位: %s", ratingText(c.Seat)),
+		fmt.Sprintf("安靜: %s", withReviewText(c.Quiet, c.Reviews.Quiet)),
+		fmt.Sprintf("便宜: %s", withReviewText(c.Price, c.Reviews.Price)),
+		fmt.Sprintf("音樂: %s", ratingText(c.Music)),
+		fmt.Sprintf("插座: %s", answerText(c.Plug, "很多", "部分座位有", "沒有")),
+		fmt.Sprintf("限時: %s", answerText(c.TimeLimited, "有限時", "看情況", "不限時")),
+		reviewsText(c.Reviews),
+	}
+	if c.OpenTime != "" {
+		lines = append(lines, fmt.Sprintf("營業時間: %s", c.OpenTime))
+	}
+	lines = append(lines, c.openingHours().Today(time.Now()))
+	lines = append(lines, fmt.Sprintf("地址: %s", c.Address))
+	if c.Link != "" {
+		lines = append(lines, fmt.Sprintf("網站: %s", c.Link))
+	}
+	// cafes added by admins or users are not on cafenomad
+	if c.Source == "" {
+		lines = append(lines, fmt.Sprintf("Cafe Nomad: https://cafenomad.tw/shop/%s", c.Id))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// findCafe loads the cafe of a postback, telling the user when it is gone.
+func findCafe(ctx context.Context, a ambassador.Ambassador, senderId, id string) (*Cafe, error) {
+	cafe, err := cafeRepo.ByID(ctx, id)
+	if err != nil {
+		log.Errorf(ctx, "can not get cafe %s: %s", id, err)
+		return nil, a.SendText(senderId, "查詢咖啡店時發生錯誤，請稍後再試")
+	}
+	if cafe == nil {
+		return nil, a.SendText(senderId, "找不到這家咖啡店，可能已經不在了")
+	}
+	return cafe, nil
+}
+
+// replyCafeDetail answers CAFE_DETAIL with every attribute of a cafe, and
+// offers directions to it, the cafes around it rated like it and to rate it.
+func replyCafeDetail(ctx context.Context, a ambassador.Ambassador, user *User, id string) error {
+	cafe, err := findCafe(ctx, a, user.Id, id)
+	if cafe == nil {
+		return err
+	}
+	user.LastCafe = cafe.Id
+	reviewed := withReviews(ctx, []Cafe{*cafe}, 0, 1)[0]
+
+	replies := []map[string]string{
+		map[string]string{
+			"content_type": "text",
+			"title":        "怎麼走",
+			"payload":      fmt.Sprintf("CAFE_DIRECTIONS:%s", cafe.Id),
+		},
+		map[string]string{
+			"content_type": "text",
+			"title":        "找相似的",
+			"payload":      fmt.Sprintf("SIMILAR_TO:%s", cafe.Id),
+		},
+		map[string]string{
+			"content_type": "text",
+			"title":        "給評分",
+			"payload":      ratePayload(cafe.Id, nil),
+		},
+	}
+	return a.AskQuestion(user.Id, cafeDetailText(reviewed), replies)
+}
+
+// replyCafeDirections answers CAFE_DIRECTIONS with links opening walking
+// directions to a cafe in Google Maps.
+func replyCafeDirections(ctx context.Context, a ambassador.Ambassador, user *User, id string) error {
+	cafe, err := findCafe(ctx, a, user.Id, id)
+	if cafe == nil {
+		return err
+	}
+	user.LastCafe = cafe.Id
+
+	destination := fmt.Sprintf("%f,%f", cafe.Latitude, cafe.Longitude)
+	directions := url.Values{"api": {"1"}, "destination": {destination}, "travelmode": {"walking"}}
+	place := url.Values{"api": {"1"}, "query": {cafe.Name + " " + cafe.Address}}
+	return a.SendTemplate(user.Id, []map[string]interface{}{
+		map[string]interface{}{
+			"title":     cafe.Name,
+			"subtitle":  cafe.Address,
+			"image_url": fmt.Sprintf("https://maps.googleapis.com/maps/api/staticmap?markers=%s&zoom=16&size=400x200", destination),
+			"buttons": []ambassador.FBButtonItem{
+				ambassador.FBButtonItem{
+					Type:  "web_url",
+					Title: "步行路線",
+					Url:   "https://www.google.com/maps/dir/?" + directions.Encode(),
+				},
+				ambassador.FBButtonItem{
+					Type:  "web_url",
+					Title: "在 Google Maps 開啟",
+					Url:   "https://www.google.com/maps/search/?" + place.Encode(),
+				},
+			},
+		},
+	})
+}
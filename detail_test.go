@@ -0,0 +1,15 @@
+package cafehunter
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCafeDetailTextLinksImportedCafesOnly(t *testing.T) {
+	for source, linked := range map[string]bool{"": true, "admin": false, "user": false} {
+		text := cafeDetailText(Cafe{Id: "cafe-01", Name: "咖啡店", Source: source})
+		if got := strings.Contains(text, "https://cafenomad.tw/shop/cafe-01"); got != linked {
+			t.Errorf("source %q: got link %v, want %v in %q", source, got, linked, text)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package cafehunter
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lemonlatte/ambassador"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/log"
+)
+
+// MAX_FAVORITES is how many cafes a user may save.
+const MAX_FAVORITES = 50
+
+// favorite is a cafe a user saved.
+type favorite struct {
+	CafeId  string    `json:"cafeId"`
+	AddedAt time.Time `json:"addedAt"`
+}
+
+// FavoriteStore keeps the cafes each sender saved. List returns them most
+// recently saved first.
+type FavoriteStore interface {
+	List(ctx context.Context, senderId string) ([]favorite, error)
+	Add(ctx context.Context, senderId string, f favorite) error
+	Remove(ctx context.Context, senderId, cafeId string) error
+}
+
+var favorites FavoriteStore
+
+// newFavoriteStore keeps favorites in the same kind of store as sessions.
+func newFavoriteStore(cfg *Config) FavoriteStore {
+	if cfg.SessionStore == "memory" {
+		return newMemoryFavoriteStore()
+	}
+	return &firebaseFavoriteStore{}
+}
+
+func sortFavorites(list []favorite) {
+	sort.Slice(list, func(i, j int) bool { return list[i].AddedAt.After(list[j].AddedAt) })
+}
+
+// memoryFavoriteStore keeps favorites in the memory of a single instance.
+type memoryFavoriteStore struct {
+	mu    sync.Mutex
+	users map[string]map[string]favorite
+}
+
+func newMemoryFavoriteStore() *memoryFavoriteStore {
+	return &memoryFavoriteStore{users: map[string]map[string]favorite{}}
+}
+
+func (s *memoryFavoriteStore) List(ctx context.Context, senderId string) ([]favorite, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := []favorite{}
+	for _, f := range s.users[senderId] {
+		list = append(list, f)
+	}
+	sortFavorites(list)
+	return list, nil
+}
+
+func (s *memoryFavoriteStore) Add(ctx context.Context, senderId string, f favorite) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.users[senderId] == nil {
+		s.users[senderId] = map[string]favorite{}
+	}
+	s.users[senderId][f.CafeId] = f
+	return nil
+}
+
+func (s *memoryFavoriteStore) Remove(ctx context.Context, senderId, cafeId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.users[senderId], cafeId)
+	return nil
+}
+
+// firebaseFavoriteStore keeps favorites under "favorites/<sender id>",
+// keyed by cafe id.
+type firebaseFavoriteStore struct{}
+
+func (s *firebaseFavoriteStore) List(ctx context.Context, senderId string) ([]favorite, error) {
+	v := map[string]favorite{}
+	if err := newFirebaseClient(ctx).Child("favorites").Child(senderId).Value(&v); err != nil {
+		return nil, err
+	}
+
+	list := make([]favorite, 0, len(v))
+	for _, f := range v {
+		list = append(list, f)
+	}
+	sortFavorites(list)
+	return list, nil
+}
+
+func (s *firebaseFavoriteStore) Add(ctx context.Context, senderId string, f favorite) error {
+	return newFirebaseClient(ctx).Child("favorites").Child(senderId).Child(f.CafeId).Set(f)
+}
+
+func (s *firebaseFavoriteStore) Remove(ctx context.Context, senderId, cafeId string) error {
+	return newFirebaseClient(ctx).Child("favorites").Child(senderId).Child(cafeId).Remove()
+}
+
+// favoriteButtons are the buttons of a cafe in the list of favorites.
+func favoriteButtons(cafe Cafe) []ambassador.FBButtonItem {
+	return []ambassador.FBButtonItem{
+		ambassador.FBButtonItem{
+			Type:    "postback",
+			Title:   "詳細資訊",
+			Payload: fmt.Sprintf("CAFE_DETAIL:%s", cafe.Id),
+		},
+		ambassador.FBButtonItem{
+			Type:    "postback",
+			Title:   "移除收藏",
+			Payload: fmt.Sprintf("FAVORITE_REMOVE:%s", cafe.Id),
+		},
+	}
+}
+
+// addFavorite answers FAVORITE_ADD.
+func addFavorite(ctx context.Context, a ambassador.Ambassador, user *User, id string) error {
+	cafe, err := findCafe(ctx, a, user.Id, id)
+	if cafe == nil {
+		return err
+	}
+
+	list, err := favorites.List(ctx, user.Id)
+	if err != nil {
+		log.Errorf(ctx, "can not list favorites of %s: %s", user.Id, err)
+		return a.SendText(user.Id, "收藏時發生錯誤，請稍後再試")
+	}
+	for _, f := range list {
+		if f.CafeId == cafe.Id {
+			return a.SendText(user.Id, fmt.Sprintf("「%s」已經在你的收藏裡了", cafe.Name))
+		}
+	}
+	if len(list) >= MAX_FAVORITES {
+		return a.SendText(user.Id, fmt.Sprintf("最多只能收藏 %d 家，請先到「我的收藏」移除一些", MAX_FAVORITES))
+	}
+
+	if err := favorites.Add(ctx, user.Id, favorite{CafeId: cafe.Id, AddedAt: time.Now()}); err != nil {
+		log.Errorf(ctx, "can not add favorite of %s: %s", user.Id, err)
+		return a.SendText(user.Id, "收藏時發生錯誤，請稍後再試")
+	}
+	return a.SendText(user.Id, fmt.Sprintf("已收藏「%s」，說「我的收藏」就能找到它", cafe.Name))
+}
+
+// removeFavorite answers FAVORITE_REMOVE.
+func removeFavorite(ctx context.Context, a ambassador.Ambassador, user *User, id string) error {
+	if err := favorites.Remove(ctx, user.Id, id); err != nil {
+		log.Errorf(ctx, "can not remove favorite of %s: %s", user.Id, err)
+		return a.SendText(user.Id, "移除收藏時發生錯誤，請稍後再試")
+	}
+	return a.SendText(user.Id, "已從收藏中移除")
+}
+
+// replyFavorites sends a page of the cafes a user saved, starting at offset.
+// Only the cafes of the page are loaded. Saved cafes no longer in the
+// repository, or failing to load, are left out.
+func replyFavorites(ctx context.Context, a ambassador.Ambassador, user *User, offset int) (err error) {
+	list, err := favorites.List(ctx, user.Id)
+	if err != nil {
+		log.Errorf(ctx, "can not list favorites of %s: %s", user.Id, err)
+		return a.SendText(user.Id, "讀取收藏時發生錯誤，請稍後再試")
+	}
+
+	n := len(list)
+	if n == 0 {
+		return a.SendText(user.Id, "你還沒有收藏任何咖啡店，在咖啡店上按「收藏」就可以囉。")
+	}
+	if offset >= n {
+		return a.SendText(user.Id, "沒有更多收藏了。")
+	}
+	size := user.Preferences.pageSize()
+	end := offset + size
+	if end > n {
+		end = n
+	}
+
+	cafes := []Cafe{}
+	for _, f := range list[offset:end] {
+		cafe, err := cafeRepo.ByID(ctx, f.CafeId)
+		if err != nil {
+			log.Errorf(ctx, "can not get cafe %s: %s", f.CafeId, err)
+			continue
+		}
+		if cafe != nil {
+			cafes = append(cafes, *cafe)
+		}
+	}
+
+	if offset == 0 {
+		if err = a.SendText(user.Id, fmt.Sprintf("你收藏了 %d 家咖啡店", n)); err != nil {
+			return
+		}
+	}
+	if len(cafes) == 0 {
+		err = a.SendText(user.Id, "這些收藏的咖啡店目前讀取不到，請稍後再試")
+	} else {
+		_, items, _ := cafeToFBTemplate(withReviews(ctx, cafes, 0, len(cafes)), 0, len(cafes), favoriteButtons)
+		err = a.SendTemplate(user.Id, items)
+	}
+	if err != nil {
+		return
+	}
+
+	if next := offset + size; next < n {
+		err = a.AskQuestion(user.Id, "還有更多收藏", []map[string]string{
+			map[string]string{
+				"content_type": "text",
+				"title":        "看更多",
+				"payload":      "FAVORITE_LIST:" + strconv.Itoa(next),
+			},
+		})
+	}
+	return
+}
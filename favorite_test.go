@@ -0,0 +1,109 @@
+package cafehunter
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/aetest"
+)
+
+// countingRepository tells which cafes were looked up by id and how many
+// times cells and surroundings were read, and fails to load the cafes of
+// broken.
+type countingRepository struct {
+	CafeRepository
+	broken  string
+	looked  []string
+	inCells int
+	nearby  int
+}
+
+func (r *countingRepository) ByID(ctx context.Context, id string) (*Cafe, error) {
+	r.looked = append(r.looked, id)
+	if id == r.broken {
+		return nil, errors.New("can not reach the cafes")
+	}
+	return r.CafeRepository.ByID(ctx, id)
+}
+
+func (r *countingRepository) InCells(ctx context.Context, cells []string) ([]Cafe, error) {
+	r.inCells++
+	return r.CafeRepository.InCells(ctx, cells)
+}
+
+func (r *countingRepository) Nearby(ctx context.Context, lat, lng, radius float64) ([]Cafe, error) {
+	r.nearby++
+	return r.CafeRepository.Nearby(ctx, lat, lng, radius)
+}
+
+// useMemoryFavorites starts the test with no favorite, until the returned
+// function restores the favorite store.
+func useMemoryFavorites() (*memoryFavoriteStore, func()) {
+	saved := favorites
+	s := newMemoryFavoriteStore()
+	favorites = s
+	return s, func() { favorites = saved }
+}
+
+func TestReplyFavoritesLoadsThePageOnly(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	defer useSampleCafes(t)()
+	repo := &countingRepository{CafeRepository: cafeRepo, broken: "sample-station-01"}
+	cafeRepo = repo
+	store, restore := useMemoryFavorites()
+	defer restore()
+
+	// most recently saved first
+	now := time.Now()
+	for i, id := range []string{"gone-01", "sample-zhongshan-01", "sample-station-01", "sample-ximen-01"} {
+		store.Add(ctx, "u", favorite{CafeId: id, AddedAt: now.Add(time.Duration(i) * time.Minute)})
+	}
+	user := &User{Id: "u", Preferences: Preferences{PageSize: 2}}
+	a := newFakeAmbassador()
+
+	if err := replyFavorites(ctx, a, user, 0); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"sample-ximen-01", "sample-station-01"}; !reflect.DeepEqual(repo.looked, want) {
+		t.Errorf("looked up %v, want %v", repo.looked, want)
+	}
+	texts := a.texts("u")
+	if len(texts) != 3 || texts[0] != "你收藏了 4 家咖啡店" {
+		t.Fatalf("got %q", texts)
+	}
+	// the cafe failing to load is left out of the page
+	if !strings.Contains(texts[1], "西門範例咖啡") || strings.Contains(texts[1], "車站範例咖啡") {
+		t.Errorf("got carousel %s", texts[1])
+	}
+	if replies := a.lastReplies("u"); len(replies) != 1 || replies[0]["payload"] != "FAVORITE_LIST:2" {
+		t.Errorf("got replies %v", replies)
+	}
+
+	repo.looked = nil
+	if err := replyFavorites(ctx, a, user, 2); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"sample-zhongshan-01", "gone-01"}; !reflect.DeepEqual(repo.looked, want) {
+		t.Errorf("looked up %v, want %v", repo.looked, want)
+	}
+	if replies := a.lastReplies("u"); replies != nil {
+		t.Errorf("offered more after the last page: %v", replies)
+	}
+
+	repo.looked = nil
+	if err := replyFavorites(ctx, a, user, 4); err != nil {
+		t.Fatal(err)
+	}
+	if texts := a.texts("u"); texts[len(texts)-1] != "沒有更多收藏了。" || repo.looked != nil {
+		t.Errorf("got %q after looking up %v", texts[len(texts)-1], repo.looked)
+	}
+}
@@ -0,0 +1,166 @@
+package cafehunter
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// cafeAttribute is a property users may ask a cafe to have.
+type cafeAttribute struct {
+	Key      string
+	Title    string
+	Keywords []string
+	Match    func(c Cafe) bool
+}
+
+// GOOD_RATING is the lowest rating regarded as good enough for a filter.
+const GOOD_RATING = 4.0
+
+// filterClock tells the time attributes such as opennow are matched at.
+var filterClock = time.Now
+
+var cafeAttributes = []cafeAttribute{
+	{"wifi", "Wifi 穩定", []string{"wifi", "網路", "上網"}, func(c Cafe) bool { return c.Wifi >= GOOD_RATING }},
+	{"quiet", "安靜", []string{"安靜", "不吵"}, func(c Cafe) bool { return c.Quiet >= GOOD_RATING }},
+	{"seat", "座位多", []string{"座位", "位子多", "位置多"}, func(c Cafe) bool { return c.Seat >= GOOD_RATING }},
+	{"tasty", "咖啡好喝", []string{"好喝"}, func(c Cafe) bool { return c.Tasty >= GOOD_RATING }},
+	{"cheap", "便宜", []string{"便宜", "平價"}, func(c Cafe) bool { return c.Price >= GOOD_RATING }},
+	{"music", "音樂好聽", []string{"音樂"}, func(c Cafe) bool { return c.Music >= GOOD_RATING }},
+	{"plug", "有插座", []string{"插座", "插頭", "充電"}, func(c Cafe) bool { return c.Plug == "yes" }},
+	{"nolimit", "不限時", []string{"不限時", "沒限時", "不限制時間"}, func(c Cafe) bool { return c.TimeLimited == "no" }},
+	{"opennow", "現在有開", []string{"現在有開", "有開的", "還有開", "營業中", "現在開"}, func(c Cafe) bool { return c.openingHours().OpenAt(filterClock()) }},
+}
+
+func findCafeAttribute(key string) *cafeAttribute {
+	for i := range cafeAttributes {
+		if cafeAttributes[i].Key == key {
+			return &cafeAttributes[i]
+		}
+	}
+	return nil
+}
+
+// CafeFilter is the set of attribute keys a cafe must have.
+type CafeFilter []string
+
+// parseCafeFilter decodes a filter written by CafeFilter.String, ignoring
+// unknown keys.
+func parseCafeFilter(s string) CafeFilter {
+	f := CafeFilter{}
+	for _, key := range strings.Split(s, ",") {
+		if findCafeAttribute(key) != nil {
+			f = f.with(key)
+		}
+	}
+	return f
+}
+
+// filterFromText matches attribute keywords in a user message, e.g.
+// "士林有插座、不限時的咖啡店".
+func filterFromText(text string) CafeFilter {
+	text = strings.ToLower(text)
+	f := CafeFilter{}
+	for _, attr := range cafeAttributes {
+		for _, k := range attr.Keywords {
+			if strings.Contains(text, k) {
+				f = f.with(attr.Key)
+				break
+			}
+		}
+	}
+	return f
+}
+
+// filterFromEntities collects the attributes LUIS recognized as "Attribute"
+// entities.
+func filterFromEntities(entities []Entity) CafeFilter {
+	f := CafeFilter{}
+	for _, e := range entities {
+		if e.Type == "Attribute" {
+			f = f.merge(filterFromText(e.Entity))
+		}
+	}
+	return f
+}
+
+func (f CafeFilter) with(key string) CafeFilter {
+	for _, k := range f {
+		if k == key {
+			return f
+		}
+	}
+	g := append(CafeFilter{}, f...)
+	g = append(g, key)
+	sort.Strings(g)
+	return g
+}
+
+func (f CafeFilter) has(key string) bool {
+	for _, k := range f {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// toggle adds key to the filter, or removes it when it is there already.
+func (f CafeFilter) toggle(key string) CafeFilter {
+	if !f.has(key) {
+		return f.with(key)
+	}
+	g := CafeFilter{}
+	for _, k := range f {
+		if k != key {
+			g = append(g, k)
+		}
+	}
+	return g
+}
+
+func (f CafeFilter) merge(g CafeFilter) CafeFilter {
+	for _, key := range g {
+		f = f.with(key)
+	}
+	return f
+}
+
+// Match reports whether a cafe has every attribute of the filter.
+func (f CafeFilter) Match(c Cafe) bool {
+	for _, key := range f {
+		if attr := findCafeAttribute(key); attr != nil && !attr.Match(c) {
+			return false
+		}
+	}
+	return true
+}
+
+// Apply returns the cafes matching the filter, keeping their order.
+func (f CafeFilter) Apply(cafes []Cafe) []Cafe {
+	if len(f) == 0 {
+		return cafes
+	}
+	matched := []Cafe{}
+	for _, c := range cafes {
+		if f.Match(c) {
+			matched = append(matched, c)
+		}
+	}
+	return matched
+}
+
+func (f CafeFilter) String() string {
+	return strings.Join(f, ",")
+}
+
+// Description lists the filter in words for the user, e.g. "有插座、不限時".
+func (f CafeFilter) Description() string {
+	titles := []string{}
+	for _, key := range f {
+		if attr := findCafeAttribute(key); attr != nil {
+			titles = append(titles, attr.Title)
+		}
+	}
+	return strings.Join(titles, "、")
+}
@@ -0,0 +1,114 @@
+package cafehunter
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFilterFromText(t *testing.T) {
+	for _, c := range []struct {
+		text string
+		want CafeFilter
+	}{
+		{"士林有插座、不限時的咖啡店", CafeFilter{"nolimit", "plug"}},
+		{"WiFi 穩定的", CafeFilter{"wifi"}},
+		{"可以上網的咖啡店", CafeFilter{"wifi"}},
+		{"網路快又不吵", CafeFilter{"quiet", "wifi"}},
+		{"位子多", CafeFilter{"seat"}},
+		{"平價好喝", CafeFilter{"cheap", "tasty"}},
+		{"音樂好聽", CafeFilter{"music"}},
+		{"可以充電", CafeFilter{"plug"}},
+		{"沒限時的", CafeFilter{"nolimit"}},
+		{"中山站附近營業中的", CafeFilter{"opennow"}},
+		{"現在有開的咖啡店", CafeFilter{"opennow"}},
+		{"中山站附近", CafeFilter{}},
+	} {
+		if got := filterFromText(c.text); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("filterFromText(%q) = %v, want %v", c.text, got, c.want)
+		}
+	}
+}
+
+func TestFilterFromEntities(t *testing.T) {
+	entities := []Entity{
+		{Entity: "插座", Type: "Attribute"},
+		{Entity: "安靜", Type: "Attribute"},
+		{Entity: "不限時", Type: "Location"},
+	}
+	if got, want := filterFromEntities(entities), (CafeFilter{"plug", "quiet"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestParseCafeFilter(t *testing.T) {
+	for s, want := range map[string]CafeFilter{
+		"":                   {},
+		"wifi":               {"wifi"},
+		"quiet,plug":         {"plug", "quiet"},
+		"plug,unknown,plug":  {"plug"},
+		"nolimit,opennow,xx": {"nolimit", "opennow"},
+	} {
+		got := parseCafeFilter(s)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("parseCafeFilter(%q) = %v, want %v", s, got, want)
+		}
+		if again := parseCafeFilter(got.String()); !reflect.DeepEqual(again, got) {
+			t.Errorf("%v was read back as %v", got, again)
+		}
+	}
+}
+
+func TestCafeFilterToggle(t *testing.T) {
+	f := CafeFilter{}.toggle("quiet").toggle("plug")
+	if want := (CafeFilter{"plug", "quiet"}); !reflect.DeepEqual(f, want) {
+		t.Errorf("got %v, want %v", f, want)
+	}
+	if f = f.toggle("quiet"); !reflect.DeepEqual(f, CafeFilter{"plug"}) {
+		t.Errorf("got %v, want plug", f)
+	}
+	if got := (CafeFilter{"plug", "nolimit"}).Description(); got != "有插座、不限時" {
+		t.Errorf("got description %q", got)
+	}
+}
+
+func TestCafeFilterMatch(t *testing.T) {
+	saved := filterClock
+	defer func() { filterClock = saved }()
+	// a Monday noon
+	filterClock = func() time.Time { return time.Date(2026, 10, 12, 12, 0, 0, 0, taipei) }
+
+	cafe := Cafe{
+		Wifi: 4, Quiet: 3.5, Seat: 5, Tasty: 4.5, Price: 2, Music: 4,
+		Plug: "yes", TimeLimited: "maybe", OpenTime: "平日 10:00-18:00",
+	}
+	for key, want := range map[string]bool{
+		"wifi":    true,
+		"quiet":   false,
+		"seat":    true,
+		"tasty":   true,
+		"cheap":   false,
+		"music":   true,
+		"plug":    true,
+		"nolimit": false,
+		"opennow": true,
+	} {
+		if got := parseCafeFilter(key).Match(cafe); got != want {
+			t.Errorf("%s: got %v, want %v", key, got, want)
+		}
+	}
+
+	// on Saturday the cafe is closed
+	filterClock = func() time.Time { return time.Date(2026, 10, 17, 12, 0, 0, 0, taipei) }
+	if parseCafeFilter("opennow").Match(cafe) {
+		t.Error("a cafe closed on weekends matched opennow on Saturday")
+	}
+	if parseCafeFilter("opennow").Match(Cafe{}) {
+		t.Error("a cafe without hours matched opennow")
+	}
+
+	cafes := []Cafe{{Id: "a", Plug: "yes", Wifi: 5}, {Id: "b", Plug: "no", Wifi: 5}, {Id: "c", Plug: "yes", Wifi: 5}}
+	if got := cafeIds(parseCafeFilter("plug,wifi").Apply(cafes)); !reflect.DeepEqual(got, []string{"a", "c"}) {
+		t.Errorf("got %v, want a and c", got)
+	}
+}
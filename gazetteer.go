@@ -0,0 +1,130 @@
+package cafehunter
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/context"
+	"googlemaps.github.io/maps"
+)
+
+// gazetteerEntry is a well known place bundled with the bot.
+type gazetteerEntry struct {
+	Name      string   `json:"name"`
+	Aliases   []string `json:"aliases"`
+	Kind      string   `json:"kind"`
+	City      string   `json:"city"`
+	Latitude  float64  `json:"lat"`
+	Longitude float64  `json:"lng"`
+}
+
+func (e gazetteerEntry) place() Place {
+	name, address := e.Name, e.City+e.Name
+	if e.Kind == "mrt" {
+		// the city of a station is its metro system, e.g. "台北捷運"
+		name, address = "捷運"+stationName(e.Name), e.City+stationName(e.Name)
+	}
+	return Place{
+		Name:             name,
+		FormattedAddress: address,
+		Geometry: maps.AddressGeometry{
+			Location: maps.LatLng{Lat: e.Latitude, Lng: e.Longitude},
+		},
+		PlaceID: fmt.Sprintf("gazetteer:%s:%s:%s", e.Kind, e.City, e.Name),
+	}
+}
+
+// gazetteerGeocoder resolves districts, MRT stations and landmarks of Taiwan
+// from a bundled dataset, so locations are understood without Google Maps.
+type gazetteerGeocoder struct {
+	entries []gazetteerEntry
+	// names maps every normalized name and alias to the entries it denotes.
+	names map[string][]int
+}
+
+func loadGazetteer(path string) (*gazetteerGeocoder, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := []gazetteerEntry{}
+	if err := json.NewDecoder(f).Decode(&entries); err != nil {
+		return nil, err
+	}
+	return newGazetteer(entries), nil
+}
+
+func newGazetteer(entries []gazetteerEntry) *gazetteerGeocoder {
+	g := &gazetteerGeocoder{entries: entries, names: map[string][]int{}}
+	for i, e := range entries {
+		names := append([]string{e.Name}, e.Aliases...)
+		if e.Kind == "mrt" {
+			names = append(names, stationName(e.Name))
+		}
+		for _, name := range names {
+			g.addName(normalizePlaceName(name), i)
+		}
+	}
+	return g
+}
+
+func (g *gazetteerGeocoder) addName(name string, i int) {
+	for _, j := range g.names[name] {
+		if j == i {
+			return
+		}
+	}
+	g.names[name] = append(g.names[name], i)
+}
+
+// normalizePlaceName drops the words around a place name people add when
+// asking, e.g. "捷運中山站附近" becomes "中山站".
+func normalizePlaceName(name string) string {
+	name = normalizeQuery(name)
+	name = strings.Replace(name, "臺", "台", -1)
+	name = strings.Replace(name, " ", "", -1)
+	name = strings.TrimPrefix(name, "捷運")
+	for _, suffix := range []string{"的咖啡店", "咖啡店", "附近", "周邊", "周圍", "旁邊", "一帶", "那邊", "這邊"} {
+		name = strings.TrimSuffix(name, suffix)
+	}
+	return name
+}
+
+// Geocode returns the entries named exactly as the query or, failing that,
+// the entries with the longest name found inside the query.
+func (g *gazetteerGeocoder) Geocode(ctx context.Context, query string) ([]Place, error) {
+	q := normalizePlaceName(query)
+
+	matched, ok := g.names[q]
+	if !ok {
+		longest := 0
+		for name, entries := range g.names {
+			if len(name) < longest || !strings.Contains(q, name) {
+				continue
+			}
+			if len(name) > longest {
+				longest = len(name)
+				matched = nil
+			}
+			matched = append(matched, entries...)
+		}
+	}
+
+	matched = append([]int{}, matched...)
+	sort.Ints(matched)
+
+	places := []Place{}
+	seen := map[int]bool{}
+	for _, i := range matched {
+		if !seen[i] {
+			seen[i] = true
+			places = append(places, g.entries[i].place())
+		}
+	}
+	return places, nil
+}
@@ -0,0 +1,169 @@
+package cafehunter
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/TomiHiltunen/geohash-golang"
+	"googlemaps.github.io/maps"
+)
+
+const (
+	EARTH_RADIUS  = 6371000.0 // meters
+	WALKING_SPEED = 80.0      // meters per minute
+)
+
+// distance returns the great-circle distance in meters between two points
+// using the haversine formula.
+func distance(lat1, lng1, lat2, lng2 float64) float64 {
+	rad := math.Pi / 180
+	dLat := (lat2 - lat1) * rad
+	dLng := (lng2 - lng1) * rad
+
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * EARTH_RADIUS * math.Asin(math.Sqrt(h))
+}
+
+// rankByDistance drops duplicated cafes and cafes farther than radius meters
+// from the given point, and sorts the rest nearest first.
+func rankByDistance(cafes []Cafe, lat, lng, radius float64) []Cafe {
+	seen := map[string]bool{}
+	ranked := []Cafe{}
+	for _, cafe := range cafes {
+		if seen[cafe.Id] {
+			continue
+		}
+		seen[cafe.Id] = true
+
+		cafe.Distance = distance(lat, lng, cafe.Latitude, cafe.Longitude)
+		if cafe.Distance <= radius {
+			ranked = append(ranked, cafe)
+		}
+	}
+
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return ranked[i].Distance < ranked[j].Distance
+	})
+	return ranked
+}
+
+// walkingText describes how far a walk of the given meters is.
+func walkingText(meters float64) string {
+	minutes := int(math.Ceil(meters / WALKING_SPEED))
+	if minutes < 1 {
+		minutes = 1
+	}
+	return fmt.Sprintf("步行約 %d 分鐘 (%.0f 公尺)", minutes, meters)
+}
+
+// project returns where a point lies relative to the segment from a to b:
+// how far along the segment its nearest point is and how far the point is
+// from it, both in meters. Segments are short enough to be taken as flat.
+func project(a, b maps.LatLng, lat, lng float64) (along, offset float64) {
+	rad := math.Pi / 180
+	scale := math.Cos(a.Lat * rad)
+	bx, by := (b.Lng-a.Lng)*scale*rad*EARTH_RADIUS, (b.Lat-a.Lat)*rad*EARTH_RADIUS
+	px, py := (lng-a.Lng)*scale*rad*EARTH_RADIUS, (lat-a.Lat)*rad*EARTH_RADIUS
+
+	length := math.Hypot(bx, by)
+	if length == 0 {
+		return 0, math.Hypot(px, py)
+	}
+	t := math.Max(0, math.Min(1, (px*bx+py*by)/(length*length)))
+	return t * length, math.Hypot(px-t*bx, py-t*by)
+}
+
+// simplifyPath drops the points of a path lying within tolerance meters of
+// the line through their neighbours, using the Douglas-Peucker algorithm.
+// The ends are always kept.
+func simplifyPath(path []maps.LatLng, tolerance float64) []maps.LatLng {
+	if len(path) < 3 {
+		return path
+	}
+	first, last := path[0], path[len(path)-1]
+	farthest, offset := 0, 0.0
+	for i := 1; i < len(path)-1; i++ {
+		if _, o := project(first, last, path[i].Lat, path[i].Lng); o > offset {
+			farthest, offset = i, o
+		}
+	}
+	if offset <= tolerance {
+		return []maps.LatLng{first, last}
+	}
+	before := simplifyPath(path[:farthest+1], tolerance)
+	after := simplifyPath(path[farthest:], tolerance)
+	return append(before[:len(before)-1:len(before)-1], after...)
+}
+
+// corridorCells returns the geohash cells covering every point within width
+// meters of a path.
+func corridorCells(path []maps.LatLng, width float64) []string {
+	precision := geohashPrecision(width)
+	seen := map[string]bool{}
+	cells := []string{}
+	add := func(lat, lng float64) {
+		h := geohash.EncodeWithPrecision(lat, lng, precision)
+		if seen[h] {
+			return
+		}
+		for _, c := range append(geohash.CalculateAllAdjacent(h), h) {
+			if !seen[c] {
+				seen[c] = true
+				cells = append(cells, c)
+			}
+		}
+	}
+
+	for i, p := range path {
+		add(p.Lat, p.Lng)
+		if i == 0 {
+			continue
+		}
+		// cells are at least width meters wide, so stepping by width never
+		// skips one
+		prev := path[i-1]
+		steps := int(math.Ceil(distance(prev.Lat, prev.Lng, p.Lat, p.Lng) / width))
+		for j := 1; j < steps; j++ {
+			f := float64(j) / float64(steps)
+			add(prev.Lat+f*(p.Lat-prev.Lat), prev.Lng+f*(p.Lng-prev.Lng))
+		}
+	}
+	sort.Strings(cells)
+	return cells
+}
+
+// rankAlongRoute drops duplicated cafes and cafes farther than width meters
+// from a path, and sorts the rest in the order they are passed along it.
+// Cafe.Detour is set to the distance off the path.
+func rankAlongRoute(cafes []Cafe, path []maps.LatLng, width float64) []Cafe {
+	seen := map[string]bool{}
+	ranked := []Cafe{}
+	position := map[string]float64{}
+	for _, cafe := range cafes {
+		if seen[cafe.Id] {
+			continue
+		}
+		seen[cafe.Id] = true
+
+		cafe.Detour = math.Inf(1)
+		travelled := 0.0
+		for i := 1; i < len(path); i++ {
+			along, offset := project(path[i-1], path[i], cafe.Latitude, cafe.Longitude)
+			if offset < cafe.Detour {
+				cafe.Detour = offset
+				position[cafe.Id] = travelled + along
+			}
+			travelled += distance(path[i-1].Lat, path[i-1].Lng, path[i].Lat, path[i].Lng)
+		}
+		if cafe.Detour <= width {
+			ranked = append(ranked, cafe)
+		}
+	}
+
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return position[ranked[i].Id] < position[ranked[j].Id]
+	})
+	return ranked
+}
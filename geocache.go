@@ -0,0 +1,167 @@
+package cafehunter
+
+import (
+	"container/list"
+	"crypto/sha1"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/log"
+)
+
+// geocodeEntry is a cached answer to a place search.
+type geocodeEntry struct {
+	Query   string    `json:"query"`
+	Places  []Place   `json:"places"`
+	Expires time.Time `json:"expires"`
+}
+
+// geocodeBackend persists cached place searches so they outlive instances.
+// Get returns a nil entry without error when the query is not stored.
+type geocodeBackend interface {
+	Get(ctx context.Context, query string) (*geocodeEntry, error)
+	Put(ctx context.Context, entry *geocodeEntry) error
+}
+
+// geocodeCache keeps the most recently used place searches in memory for a
+// limited time, in front of an optional geocodeBackend.
+type geocodeCache struct {
+	ttl     time.Duration
+	size    int
+	backend geocodeBackend
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	recent  *list.List
+
+	hits   int64
+	misses int64
+}
+
+func newGeocodeCache(ttl time.Duration, size int, backend geocodeBackend) *geocodeCache {
+	return &geocodeCache{
+		ttl:     ttl,
+		size:    size,
+		backend: backend,
+		entries: map[string]*list.Element{},
+		recent:  list.New(),
+	}
+}
+
+// normalizeQuery makes queries differing only in case, spacing or trailing
+// punctuation share a cache entry.
+func normalizeQuery(query string) string {
+	query = strings.ToLower(strings.Join(strings.Fields(query), " "))
+	return strings.TrimRight(query, "?？!！.。~")
+}
+
+// Get returns the cached places of a query.
+func (c *geocodeCache) Get(ctx context.Context, query string) ([]Place, bool) {
+	key := normalizeQuery(query)
+	now := time.Now()
+
+	if entry := c.getMemory(key, now); entry != nil {
+		atomic.AddInt64(&c.hits, 1)
+		return entry.Places, true
+	}
+
+	if c.backend != nil {
+		entry, err := c.backend.Get(ctx, key)
+		if err != nil {
+			log.Warningf(ctx, "can not read geocode cache: %s", err)
+		} else if entry != nil && now.Before(entry.Expires) {
+			c.putMemory(entry)
+			atomic.AddInt64(&c.hits, 1)
+			return entry.Places, true
+		}
+	}
+
+	atomic.AddInt64(&c.misses, 1)
+	return nil, false
+}
+
+// Put caches the places of a query.
+func (c *geocodeCache) Put(ctx context.Context, query string, places []Place) {
+	entry := &geocodeEntry{
+		Query:   normalizeQuery(query),
+		Places:  places,
+		Expires: time.Now().Add(c.ttl),
+	}
+	c.putMemory(entry)
+
+	if c.backend != nil {
+		if err := c.backend.Put(ctx, entry); err != nil {
+			log.Warningf(ctx, "can not write geocode cache: %s", err)
+		}
+	}
+}
+
+// Stats returns the number of cache hits and misses so far.
+func (c *geocodeCache) Stats() (hits, misses int64) {
+	return atomic.LoadInt64(&c.hits), atomic.LoadInt64(&c.misses)
+}
+
+func (c *geocodeCache) getMemory(key string, now time.Time) *geocodeEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := e.Value.(*geocodeEntry)
+	if !now.Before(entry.Expires) {
+		c.recent.Remove(e)
+		delete(c.entries, key)
+		return nil
+	}
+	c.recent.MoveToFront(e)
+	return entry
+}
+
+func (c *geocodeCache) putMemory(entry *geocodeEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[entry.Query]; ok {
+		e.Value = entry
+		c.recent.MoveToFront(e)
+		return
+	}
+
+	c.entries[entry.Query] = c.recent.PushFront(entry)
+	for c.recent.Len() > c.size {
+		oldest := c.recent.Back()
+		c.recent.Remove(oldest)
+		delete(c.entries, oldest.Value.(*geocodeEntry).Query)
+	}
+}
+
+// firebaseGeocodeBackend stores cached place searches under the "geocodes"
+// path of Firebase, keyed by a hash since queries may hold characters
+// Firebase keys can not.
+type firebaseGeocodeBackend struct{}
+
+func geocodeKey(query string) string {
+	sum := sha1.Sum([]byte(query))
+	return hex.EncodeToString(sum[:])
+}
+
+func (b *firebaseGeocodeBackend) Get(ctx context.Context, query string) (*geocodeEntry, error) {
+	var entry *geocodeEntry
+	if err := newFirebaseClient(ctx).Child("geocodes").Child(geocodeKey(query)).Value(&entry); err != nil {
+		return nil, err
+	}
+	if entry == nil || entry.Query != query {
+		return nil, nil
+	}
+	return entry, nil
+}
+
+func (b *firebaseGeocodeBackend) Put(ctx context.Context, entry *geocodeEntry) error {
+	return newFirebaseClient(ctx).Child("geocodes").Child(geocodeKey(entry.Query)).Set(entry)
+}
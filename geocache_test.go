@@ -0,0 +1,105 @@
+package cafehunter
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/aetest"
+)
+
+// memoryGeocodeBackend keeps cached place searches in a map.
+type memoryGeocodeBackend map[string]geocodeEntry
+
+func (b memoryGeocodeBackend) Get(ctx context.Context, query string) (*geocodeEntry, error) {
+	entry, ok := b[query]
+	if !ok {
+		return nil, nil
+	}
+	return &entry, nil
+}
+
+func (b memoryGeocodeBackend) Put(ctx context.Context, entry *geocodeEntry) error {
+	b[entry.Query] = *entry
+	return nil
+}
+
+func TestNormalizeQuery(t *testing.T) {
+	for _, c := range []struct {
+		query, want string
+	}{
+		{"台北101", "台北101"},
+		{"  台北101  ", "台北101"},
+		{"台北101？", "台北101"},
+		{"台北101?!", "台北101"},
+		{"Taipei   Main  Station.", "taipei main station"},
+		{"中山站附近~", "中山站附近"},
+	} {
+		if got := normalizeQuery(c.query); got != c.want {
+			t.Errorf("normalizeQuery(%q) = %q, want %q", c.query, got, c.want)
+		}
+	}
+}
+
+func TestGeocodeCacheExpiry(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	const TTL = 50 * time.Millisecond
+	backend := memoryGeocodeBackend{}
+	cache := newGeocodeCache(TTL, 10, backend)
+	cache.Put(ctx, "公館", []Place{{Name: "公館"}})
+	if _, ok := cache.Get(ctx, "公館"); !ok {
+		t.Fatal("a fresh entry missed")
+	}
+
+	time.Sleep(2 * TTL)
+	if _, ok := cache.Get(ctx, "公館"); ok {
+		t.Error("an expired entry hit")
+	}
+
+	// entries outliving the instance come from the backend until they expire
+	backend.Put(ctx, &geocodeEntry{Query: "大安", Places: []Place{{Name: "大安"}}, Expires: time.Now().Add(time.Hour)})
+	backend.Put(ctx, &geocodeEntry{Query: "士林", Places: []Place{{Name: "士林"}}, Expires: time.Now().Add(-time.Second)})
+	if places, ok := cache.Get(ctx, "大安"); !ok || places[0].Name != "大安" {
+		t.Errorf("a stored entry missed: %+v", places)
+	}
+	if _, ok := cache.Get(ctx, "士林"); ok {
+		t.Error("an expired stored entry hit")
+	}
+}
+
+func TestGeocodeCacheEviction(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	const SIZE = 3
+	cache := newGeocodeCache(time.Hour, SIZE, nil)
+	for i := 0; i < SIZE; i++ {
+		cache.Put(ctx, fmt.Sprintf("place %d", i), []Place{{Name: fmt.Sprint(i)}})
+	}
+	// place 0 becomes the most recently used, leaving place 1 the least
+	if _, ok := cache.Get(ctx, "place 0"); !ok {
+		t.Fatal("place 0 missed")
+	}
+	cache.Put(ctx, "place 3", []Place{{Name: "3"}})
+
+	if n := cache.recent.Len(); n != SIZE {
+		t.Errorf("got %d entries, want %d", n, SIZE)
+	}
+	for _, c := range []struct {
+		query string
+		hit   bool
+	}{{"place 0", true}, {"place 1", false}, {"place 2", true}, {"place 3", true}} {
+		if _, ok := cache.Get(ctx, c.query); ok != c.hit {
+			t.Errorf("%s: got hit %v, want %v", c.query, ok, c.hit)
+		}
+	}
+}
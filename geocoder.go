@@ -0,0 +1,147 @@
+package cafehunter
+
+import (
+	"fmt"
+	"net/http"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/urlfetch"
+	"googlemaps.github.io/maps"
+)
+
+// Geocoder resolves what a user calls a place in Taiwan into candidate
+// places. It returns no places without error when nothing matches.
+type Geocoder interface {
+	Geocode(ctx context.Context, query string) ([]Place, error)
+}
+
+// newGeocoder matches metro station names first, then resolves places with
+// Google Maps, through the geocode cache, and falls back on the bundled
+// gazetteer and stations when Google fails or finds nothing. Without a Maps
+// API key only the bundled data is used.
+func newGeocoder(cfg *Config, metro *metroCatalogue) (Geocoder, error) {
+	gazetteer, err := loadGazetteer(cfg.GazetteerFile)
+	if err != nil {
+		return nil, fmt.Errorf("can not load gazetteer %s: %s", cfg.GazetteerFile, err)
+	}
+	gazetteer = newGazetteer(append(gazetteer.entries, metro.gazetteerEntries()...))
+	if cfg.GoogleMapsAPIKey == "" {
+		return fallbackGeocoder{metro, gazetteer}, nil
+	}
+
+	google := &cachedGeocoder{cache: geocodes, next: &googleGeocoder{}}
+	return fallbackGeocoder{metro, google, gazetteer}, nil
+}
+
+// fallbackGeocoder asks each geocoder in turn until one finds a place.
+type fallbackGeocoder []Geocoder
+
+func (f fallbackGeocoder) Geocode(ctx context.Context, query string) (places []Place, err error) {
+	for _, g := range f {
+		places, err = g.Geocode(ctx, query)
+		if err != nil {
+			log.Warningf(ctx, "geocoder %T failed: %s", g, err)
+			continue
+		}
+		if len(places) > 0 {
+			return places, nil
+		}
+	}
+	return places, err
+}
+
+// cachedGeocoder answers repeated queries from a geocodeCache.
+type cachedGeocoder struct {
+	cache *geocodeCache
+	next  Geocoder
+}
+
+func (c *cachedGeocoder) Geocode(ctx context.Context, query string) ([]Place, error) {
+	if places, ok := c.cache.Get(ctx, query); ok {
+		return places, nil
+	}
+
+	places, err := c.next.Geocode(ctx, query)
+	if err == nil && len(places) > 0 {
+		c.cache.Put(ctx, query, places)
+	}
+	return places, err
+}
+
+var geocodes *geocodeCache
+
+func newGeocodeBackend(cfg *Config) geocodeBackend {
+	if cfg.GeocodeCacheStore == "firebase" {
+		return &firebaseGeocodeBackend{}
+	}
+	return nil
+}
+
+func geocodeCacheStatsHandler(w http.ResponseWriter, r *http.Request) {
+	hits, misses := geocodes.Stats()
+	fmt.Fprintf(w, "hits: %d\nmisses: %d\n", hits, misses)
+}
+
+// mapsClient is the part of the Google Maps client used to resolve places
+// and routes, so that a fake one can stand in for it.
+type mapsClient interface {
+	TextSearch(ctx context.Context, r *maps.TextSearchRequest) (maps.PlacesSearchResponse, error)
+	Geocode(ctx context.Context, r *maps.GeocodingRequest) ([]maps.GeocodingResult, error)
+	Directions(ctx context.Context, r *maps.DirectionsRequest) ([]maps.Route, []maps.GeocodedWaypoint, error)
+}
+
+var newMapsClient = func(ctx context.Context) (mapsClient, error) {
+	client := urlfetch.Client(ctx)
+	return maps.NewClient(maps.WithAPIKey(config.GoogleMapsAPIKey), maps.WithHTTPClient(client))
+}
+
+// googleGeocoder searches places with Google Maps and falls back on its
+// geocoding API when the text search finds nothing.
+type googleGeocoder struct{}
+
+func (g *googleGeocoder) Geocode(ctx context.Context, query string) ([]Place, error) {
+	c, err := newMapsClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("can not create google map api client: %s", err)
+	}
+
+	places := []Place{}
+	placesResp, err := c.TextSearch(ctx, &maps.TextSearchRequest{
+		Query:    fmt.Sprintf("%s+in+Taiwan", query),
+		Language: "zh-TW",
+	})
+	if err != nil {
+		log.Warningf(ctx, "google text search failed: %s", err)
+	} else if len(placesResp.Results) > 0 {
+		for _, r := range placesResp.Results {
+			places = append(places, Place{
+				Name:             r.Name,
+				Geometry:         r.Geometry,
+				FormattedAddress: r.FormattedAddress,
+				PlaceID:          r.PlaceID,
+			})
+		}
+		return places, nil
+	}
+
+	geocodingResults, err := c.Geocode(ctx, &maps.GeocodingRequest{
+		Address: query,
+		Components: map[maps.Component]string{
+			maps.ComponentCountry: "TW",
+		},
+		Language: "zh-TW",
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range geocodingResults {
+		places = append(places, Place{
+			Name:             r.FormattedAddress,
+			Geometry:         r.Geometry,
+			FormattedAddress: r.FormattedAddress,
+			PlaceID:          r.PlaceID,
+		})
+	}
+	return places, nil
+}
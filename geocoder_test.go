@@ -0,0 +1,199 @@
+package cafehunter
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/aetest"
+	"googlemaps.github.io/maps"
+)
+
+// fakeMapsClient answers text searches from places by query and directions
+// with routes, finds nothing through the geocoding API and counts the
+// requests made.
+type fakeMapsClient struct {
+	mu         sync.Mutex
+	places     map[string][]maps.PlacesSearchResult
+	routes     []maps.Route
+	err        error
+	requests   int
+	directions int
+}
+
+func (c *fakeMapsClient) TextSearch(ctx context.Context, r *maps.TextSearchRequest) (maps.PlacesSearchResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.requests++
+	if c.err != nil {
+		return maps.PlacesSearchResponse{}, c.err
+	}
+	return maps.PlacesSearchResponse{Results: c.places[strings.TrimSuffix(r.Query, "+in+Taiwan")]}, nil
+}
+
+func (c *fakeMapsClient) Geocode(ctx context.Context, r *maps.GeocodingRequest) ([]maps.GeocodingResult, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.requests++
+	return nil, c.err
+}
+
+func (c *fakeMapsClient) Directions(ctx context.Context, r *maps.DirectionsRequest) ([]maps.Route, []maps.GeocodedWaypoint, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.requests++
+	c.directions++
+	if c.err != nil {
+		return nil, nil, c.err
+	}
+	return c.routes, nil, nil
+}
+
+func (c *fakeMapsClient) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.requests
+}
+
+// useFakeMapsClient makes Google Maps requests go to c, until the returned
+// function restores the real client.
+func useFakeMapsClient(c *fakeMapsClient) func() {
+	saved := newMapsClient
+	newMapsClient = func(ctx context.Context) (mapsClient, error) { return c, nil }
+	return func() { newMapsClient = saved }
+}
+
+func taipei101() maps.PlacesSearchResult {
+	r := maps.PlacesSearchResult{Name: "台北101", FormattedAddress: "110台北市信義區信義路五段7號", PlaceID: "taipei-101"}
+	r.Geometry.Location = maps.LatLng{Lat: 25.033964, Lng: 121.564468}
+	return r
+}
+
+func TestCachedGeocoder(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	client := &fakeMapsClient{places: map[string][]maps.PlacesSearchResult{"台北101": {taipei101()}}}
+	defer useFakeMapsClient(client)()
+	cache := newGeocodeCache(time.Hour, 10, nil)
+	g := &cachedGeocoder{cache: cache, next: &googleGeocoder{}}
+
+	for _, query := range []string{"台北101", "台北101", "  台北101？", "台北101!"} {
+		places, err := g.Geocode(ctx, query)
+		if err != nil {
+			t.Fatalf("%q: %s", query, err)
+		}
+		if len(places) != 1 || places[0].PlaceID != "taipei-101" {
+			t.Fatalf("%q: got %+v", query, places)
+		}
+	}
+	if n := client.count(); n != 1 {
+		t.Errorf("got %d requests to Google, want 1", n)
+	}
+	if hits, misses := cache.Stats(); hits != 3 || misses != 1 {
+		t.Errorf("got %d hits and %d misses, want 3 and 1", hits, misses)
+	}
+
+	// nothing found is not cached, so a place added later is found
+	for i := 0; i < 2; i++ {
+		if places, err := g.Geocode(ctx, "不存在的地方"); err != nil || len(places) != 0 {
+			t.Fatalf("got %+v, %v", places, err)
+		}
+	}
+	if n := client.count(); n != 5 {
+		t.Errorf("empty results were cached: got %d requests, want 5", n)
+	}
+
+	// neither are failures
+	client.err = errors.New("OVER_QUERY_LIMIT")
+	if _, err := g.Geocode(ctx, "信義區"); err == nil {
+		t.Fatal("the failure of Google was not returned")
+	}
+	client.err = nil
+	client.places["信義區"] = []maps.PlacesSearchResult{taipei101()}
+	if places, err := g.Geocode(ctx, "信義區"); err != nil || len(places) != 1 {
+		t.Errorf("a failed search was cached: got %+v, %v", places, err)
+	}
+}
+
+func TestGeocoderOffline(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	cfg := testConfig()
+	cfg.GoogleMapsAPIKey = ""
+	metro, err := loadMetro(cfg.MetroFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := newGeocoder(cfg, metro)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := g.(fallbackGeocoder); !ok {
+		t.Fatalf("got a %T without an API key", g)
+	}
+
+	for _, c := range []struct {
+		query    string
+		name     string
+		lat, lng float64
+	}{
+		{"中山站附近", "捷運中山站", 25.0527, 121.5204},
+		{"古亭站", "捷運古亭站", 25.0264, 121.5229},
+		{"萬華", "萬華區", 25.0285, 121.4977},
+	} {
+		places, err := g.Geocode(ctx, c.query)
+		if err != nil {
+			t.Fatalf("%s: %s", c.query, err)
+		}
+		if len(places) != 1 {
+			t.Fatalf("%s: got %d places %+v, want 1", c.query, len(places), places)
+		}
+		p := places[0]
+		if p.Name != c.name || p.Geometry.Location.Lat != c.lat || p.Geometry.Location.Lng != c.lng {
+			t.Errorf("%s: got %s at %v", c.query, p.Name, p.Geometry.Location)
+		}
+	}
+}
+
+func TestGeocoderFallsBackWhenGoogleFails(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	client := &fakeMapsClient{err: errors.New("REQUEST_DENIED")}
+	defer useFakeMapsClient(client)()
+	cfg := testConfig()
+	cfg.GoogleMapsAPIKey = "test-maps-key"
+	metro, err := loadMetro(cfg.MetroFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := newGeocoder(cfg, metro)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	places, err := g.Geocode(ctx, "萬華區")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(places) != 1 || places[0].Name != "萬華區" {
+		t.Errorf("got %+v, want 萬華區 from the gazetteer", places)
+	}
+	if client.count() == 0 {
+		t.Error("Google was not asked before the gazetteer")
+	}
+}
@@ -0,0 +1,89 @@
+package cafehunter
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lemonlatte/ambassador"
+	"golang.org/x/net/context"
+)
+
+// MAX_HISTORY is how many searches are kept per user, one quick reply each.
+const MAX_HISTORY = 10
+
+// searchRecord is a search a user made around a point.
+type searchRecord struct {
+	Text      string    `json:"text"`
+	Latitude  float64   `json:"lat"`
+	Longitude float64   `json:"lng"`
+	Time      time.Time `json:"time"`
+}
+
+func (r searchRecord) samePlace(lat, lng float64) bool {
+	return fmt.Sprintf("%f,%f", r.Latitude, r.Longitude) == fmt.Sprintf("%f,%f", lat, lng)
+}
+
+// remember records a search around a point in the history of a user, most
+// recent first, under user.LastText, the place the user asked about. A
+// search at a point already in the history moves it to the front, so tapping
+// a past search or sorting the results again keeps its text. Other searches
+// not following a question of the user, e.g. from a station of a metro line,
+// are not recorded.
+func (user *User) remember(lat, lng float64, now time.Time) {
+	text := user.LastText
+	user.LastText = ""
+
+	history := []searchRecord{}
+	for _, r := range user.History {
+		if r.samePlace(lat, lng) {
+			if text == "" {
+				text = r.Text
+			}
+			continue
+		}
+		history = append(history, r)
+	}
+	if text == "" {
+		return
+	}
+
+	user.History = append([]searchRecord{{text, lat, lng, now}}, history...)
+	if len(user.History) > MAX_HISTORY {
+		user.History = user.History[:MAX_HISTORY]
+	}
+}
+
+// searchNearby replies with the cafes matching a query and records the
+// search in the history of the user.
+func searchNearby(ctx context.Context, a ambassador.Ambassador, user *User, q cafeQuery) error {
+	if q.Offset == 0 {
+		user.remember(q.Latitude, q.Longitude, time.Now())
+	}
+	return replyCafesNearby(ctx, a, user.Id, q)
+}
+
+// replyHistory answers "最近查詢" with the recent searches of a user as quick
+// replies running them again.
+func replyHistory(a ambassador.Ambassador, user *User) error {
+	if len(user.History) == 0 {
+		return a.SendText(user.Id, "你最近還沒有查詢過咖啡店喔。")
+	}
+
+	lines := []string{"最近查詢："}
+	replies := []map[string]string{}
+	for i, r := range user.History {
+		lines = append(lines, fmt.Sprintf("%d. %s (%s)", i+1, r.Text, r.Time.In(taipei).Format("1/2 15:04")))
+		replies = append(replies, map[string]string{
+			"content_type": "text",
+			"title":        fitLines([]string{fmt.Sprintf("%d. %s", i+1, r.Text)}, QUICK_REPLY_TITLE_LIMIT),
+			"payload":      fmt.Sprintf("FIND_CAFE_GEOCODING:%f,%f", r.Latitude, r.Longitude),
+		})
+	}
+	replies = append(replies, map[string]string{
+		"content_type": "text",
+		"title":        "清除紀錄",
+		"payload":      "HISTORY_CLEAR",
+	})
+	return a.AskQuestion(user.Id, strings.Join(lines, "\n"), replies)
+}
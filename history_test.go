@@ -0,0 +1,100 @@
+package cafehunter
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func historyTexts(user *User) []string {
+	texts := []string{}
+	for _, r := range user.History {
+		texts = append(texts, r.Text)
+	}
+	return texts
+}
+
+func TestRemember(t *testing.T) {
+	now := time.Date(2026, 10, 14, 15, 0, 0, 0, taipei)
+	user := &User{Id: "u"}
+
+	user.LastText = "西門町"
+	user.remember(25.0421, 121.5081, now)
+	user.LastText = "台北車站"
+	user.remember(25.0478, 121.5170, now.Add(time.Minute))
+	if want := []string{"台北車站", "西門町"}; !reflect.DeepEqual(historyTexts(user), want) {
+		t.Fatalf("got %v, want %v", historyTexts(user), want)
+	}
+	if user.LastText != "" {
+		t.Errorf("LastText %q was kept for the next search", user.LastText)
+	}
+
+	// searching the same place again moves it to the front, with its new text
+	user.LastText = "西門"
+	user.remember(25.0421, 121.5081, now.Add(2*time.Minute))
+	if want := []string{"西門", "台北車站"}; !reflect.DeepEqual(historyTexts(user), want) {
+		t.Errorf("got %v, want %v", historyTexts(user), want)
+	}
+	if !user.History[0].Time.Equal(now.Add(2 * time.Minute)) {
+		t.Errorf("got time %s of the repeated search", user.History[0].Time)
+	}
+
+	// or with its old text when it follows no question, as tapping a past search
+	user.remember(25.0478, 121.5170, now.Add(3*time.Minute))
+	if want := []string{"台北車站", "西門"}; !reflect.DeepEqual(historyTexts(user), want) {
+		t.Errorf("got %v, want %v", historyTexts(user), want)
+	}
+
+	// a new place following no question is not recorded
+	user.remember(25.0330, 121.5654, now.Add(4*time.Minute))
+	if want := []string{"台北車站", "西門"}; !reflect.DeepEqual(historyTexts(user), want) {
+		t.Errorf("got %v, want %v", historyTexts(user), want)
+	}
+}
+
+func TestRememberKeepsTheLatestSearches(t *testing.T) {
+	now := time.Date(2026, 10, 14, 15, 0, 0, 0, taipei)
+	user := &User{Id: "u"}
+	for i := 0; i < MAX_HISTORY+3; i++ {
+		user.LastText = fmt.Sprintf("place %d", i)
+		user.remember(25.0+float64(i)/100, 121.5, now.Add(time.Duration(i)*time.Minute))
+	}
+	if len(user.History) != MAX_HISTORY {
+		t.Fatalf("got %d searches, want %d", len(user.History), MAX_HISTORY)
+	}
+	if first, last := user.History[0].Text, user.History[MAX_HISTORY-1].Text; first != fmt.Sprintf("place %d", MAX_HISTORY+2) || last != "place 3" {
+		t.Errorf("got %s to %s", first, last)
+	}
+}
+
+func TestReplyHistory(t *testing.T) {
+	a := newFakeAmbassador()
+	user := &User{Id: "u", History: []searchRecord{
+		{Text: "板南線從西門到台北車站沿線適合工作的咖啡店", Latitude: 25.0421, Longitude: 121.5081},
+		{Text: "公館", Latitude: 25.0147, Longitude: 121.5343},
+	}}
+	if err := replyHistory(a, user); err != nil {
+		t.Fatal(err)
+	}
+
+	replies := a.lastReplies("u")
+	if len(replies) != 3 {
+		t.Fatalf("got %d quick replies, want 3", len(replies))
+	}
+	for _, r := range replies {
+		if n := utf8.RuneCountInString(r["title"]); n > QUICK_REPLY_TITLE_LIMIT {
+			t.Errorf("title %q has %d characters, want at most %d", r["title"], n, QUICK_REPLY_TITLE_LIMIT)
+		}
+	}
+	if want := "1. 板南線從西門到台北車站沿線適合工…"; replies[0]["title"] != want {
+		t.Errorf("got title %q, want %q", replies[0]["title"], want)
+	}
+	if want := "FIND_CAFE_GEOCODING:25.042100,121.508100"; replies[0]["payload"] != want {
+		t.Errorf("got payload %q, want %q", replies[0]["payload"], want)
+	}
+	if replies[1]["title"] != "2. 公館" || replies[2]["payload"] != "HISTORY_CLEAR" {
+		t.Errorf("got replies %v", replies[1:])
+	}
+}
@@ -0,0 +1,205 @@
+package cafehunter
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// taipei is the time zone opening hours are written in. App Engine may not
+// ship the zone database, in which case the fixed offset is used.
+var taipei = func() *time.Location {
+	if loc, err := time.LoadLocation("Asia/Taipei"); err == nil {
+		return loc
+	}
+	return time.FixedZone("CST", 8*60*60)
+}()
+
+// TimeRange is a period a cafe is open, in minutes since midnight. Close
+// is past 1440 when the cafe closes after midnight.
+type TimeRange struct {
+	Open  int `json:"open"`
+	Close int `json:"close"`
+}
+
+func (r TimeRange) String() string {
+	end := r.Close
+	if end > 24*60 {
+		end -= 24 * 60
+	}
+	return fmt.Sprintf("%02d:%02d-%02d:%02d", r.Open/60, r.Open%60, end/60, end%60)
+}
+
+// OpeningHours is the weekly schedule of a cafe, indexed by time.Weekday.
+// A day without ranges is a day off.
+type OpeningHours struct {
+	Days [7][]TimeRange `json:"days"`
+}
+
+// OpenAt reports whether the cafe is open at t. Unknown hours, a nil
+// schedule, are never open.
+func (h *OpeningHours) OpenAt(t time.Time) bool {
+	if h == nil {
+		return false
+	}
+	t = t.In(taipei)
+	day := t.Weekday()
+	minute := t.Hour()*60 + t.Minute()
+
+	for _, r := range h.Days[day] {
+		if r.Open <= minute && minute < r.Close {
+			return true
+		}
+	}
+	for _, r := range h.Days[(day+6)%7] {
+		if minute+24*60 < r.Close {
+			return true
+		}
+	}
+	return false
+}
+
+// Today describes the hours of the day of t, e.g. "今日 09:00-18:00".
+func (h *OpeningHours) Today(t time.Time) string {
+	if h == nil {
+		return "營業時間未提供"
+	}
+	ranges := h.Days[t.In(taipei).Weekday()]
+	if len(ranges) == 0 {
+		return "今日公休"
+	}
+	texts := []string{}
+	for _, r := range ranges {
+		texts = append(texts, r.String())
+	}
+	return "今日 " + strings.Join(texts, ", ")
+}
+
+var (
+	hoursReplacer = strings.NewReplacer(
+		"：", ":", "～", "-", "~", "-", "－", "-", "–", "-", "—", "-", "〜", "-",
+		"至", "-", "到", "-", "臺", "台", "星期", "週", "禮拜", "週", "周", "週",
+	)
+	hoursToken = regexp.MustCompile(
+		`週([一二三四五六日天](?:、?[一二三四五六日天])*)(?:\s*-\s*週?([一二三四五六日天]))?` +
+			`|(平日|假日|週末|每日|每天|全年無休|全日)` +
+			`|(\d{1,2})(?::(\d{2}))?\s*-\s*(\d{1,2})(?::(\d{2}))?` +
+			`|(24\s*小時)` +
+			`|(公休|店休|休息|不營業)`)
+	weekdays = map[string]time.Weekday{
+		"日": time.Sunday, "天": time.Sunday, "一": time.Monday, "二": time.Tuesday,
+		"三": time.Wednesday, "四": time.Thursday, "五": time.Friday, "六": time.Saturday,
+	}
+)
+
+// parseOpeningHours reads the free text cafenomad keeps opening hours in,
+// such as "週一至週五 08:00-18:00，週六日 10:00~22:00，週一公休". Days
+// apply to the hours following them, hours before any day apply to the
+// whole week, and days off win over any hours. It returns nil when no hours
+// are found.
+func parseOpeningHours(text string) *OpeningHours {
+	text = hoursReplacer.Replace(text)
+
+	h := &OpeningHours{}
+	found := false
+	days := allDays()
+	daysSet, closeNext := false, false
+	lastWasDays := false
+	closed := []time.Weekday{}
+
+	for _, m := range hoursToken.FindAllStringSubmatch(text, -1) {
+		switch {
+		case m[1] != "":
+			set := []time.Weekday{}
+			for _, c := range strings.Split(strings.Replace(m[1], "、", "", -1), "") {
+				set = append(set, weekdays[c])
+			}
+			if m[2] != "" {
+				set = weekdayRange(set[len(set)-1], weekdays[m[2]])
+			}
+			days = joinDays(days, set, lastWasDays && daysSet)
+			daysSet, lastWasDays = true, true
+		case m[3] != "":
+			var set []time.Weekday
+			switch m[3] {
+			case "平日":
+				set = weekdayRange(time.Monday, time.Friday)
+			case "假日", "週末":
+				set = []time.Weekday{time.Saturday, time.Sunday}
+			default:
+				set = allDays()
+			}
+			days = joinDays(days, set, lastWasDays && daysSet)
+			daysSet, lastWasDays = true, true
+		case m[4] != "" || m[8] != "":
+			r := TimeRange{0, 24 * 60}
+			if m[4] != "" {
+				r = TimeRange{clockMinutes(m[4], m[5]), clockMinutes(m[6], m[7])}
+				if r.Close <= r.Open {
+					r.Close += 24 * 60
+				}
+			}
+			for _, d := range days {
+				h.Days[d] = append(h.Days[d], r)
+			}
+			found, lastWasDays = true, false
+		case m[9] != "":
+			if lastWasDays {
+				closed = append(closed, days...)
+			} else {
+				closeNext = true
+			}
+			found, lastWasDays = true, false
+			continue
+		}
+		if closeNext && lastWasDays {
+			// "公休：週三" names days off only, later hours are for the rest
+			closed = append(closed, days...)
+			days, daysSet, lastWasDays, closeNext = allDays(), false, false, false
+		}
+	}
+
+	if !found {
+		return nil
+	}
+	for _, d := range closed {
+		h.Days[d] = nil
+	}
+	for d := range h.Days {
+		sort.Slice(h.Days[d], func(i, j int) bool { return h.Days[d][i].Open < h.Days[d][j].Open })
+	}
+	return h
+}
+
+func allDays() []time.Weekday {
+	return weekdayRange(time.Sunday, time.Saturday)
+}
+
+// weekdayRange returns the days from one weekday to another, wrapping past
+// Saturday, e.g. 週五至週一.
+func weekdayRange(from, to time.Weekday) []time.Weekday {
+	days := []time.Weekday{from}
+	for d := from; d != to; {
+		d = (d + 1) % 7
+		days = append(days, d)
+	}
+	return days
+}
+
+// joinDays adds days to the current ones when they are listed together, as
+// in "週一、週三", and replaces them otherwise.
+func joinDays(current, days []time.Weekday, together bool) []time.Weekday {
+	if !together {
+		return days
+	}
+	return append(append([]time.Weekday{}, current...), days...)
+}
+
+func clockMinutes(hour, minute string) int {
+	hh, _ := strconv.Atoi(hour)
+	mm, _ := strconv.Atoi(minute)
+	return hh*60 + mm
+}
@@ -0,0 +1,142 @@
+package cafehunter
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// at returns the time of a weekday in the week of Sunday 2026-10-11, in
+// Taipei.
+func at(day time.Weekday, hour, minute int) time.Time {
+	return time.Date(2026, 10, 11+int(day), hour, minute, 0, 0, taipei)
+}
+
+// week returns a schedule opening the days given with r and closing the
+// others.
+func week(r TimeRange, days ...time.Weekday) [7][]TimeRange {
+	var w [7][]TimeRange
+	for _, d := range days {
+		w[d] = []TimeRange{r}
+	}
+	return w
+}
+
+func TestParseOpeningHours(t *testing.T) {
+	var (
+		office  = TimeRange{8 * 60, 18 * 60}
+		weekend = TimeRange{10 * 60, 22 * 60}
+		night   = TimeRange{18 * 60, 26 * 60}
+	)
+	mixed := week(office, weekdayRange(time.Monday, time.Friday)...)
+	mixed[time.Saturday] = []TimeRange{weekend}
+	mixed[time.Sunday] = []TimeRange{weekend}
+	split := week(TimeRange{11 * 60, 14 * 60}, allDays()...)
+	for d := range split {
+		split[d] = append(split[d], TimeRange{17*60 + 30, 21 * 60})
+	}
+
+	for _, c := range []struct {
+		text string
+		want *[7][]TimeRange
+	}{
+		{"08:00-18:00", func() *[7][]TimeRange { w := week(office, allDays()...); return &w }()},
+		{"週一至週五 08:00-18:00，週六日 10:00~22:00", &mixed},
+		{"平日 8:00-18:00 假日 10:00-22:00", &mixed},
+		{"星期一～星期五 08：00－18：00、週末 10:00-22:00", &mixed},
+		{"每日 17:30-21:00, 11:00-14:00", &split},
+		{"週六、週日 10:00-22:00", func() *[7][]TimeRange { w := week(weekend, time.Saturday, time.Sunday); return &w }()},
+		// a day off named after the hours
+		{"每日 08:00-18:00，週一公休", func() *[7][]TimeRange { w := week(office, allDays()...); w[time.Monday] = nil; return &w }()},
+		// and before them
+		{"公休：週三 08:00-18:00", func() *[7][]TimeRange { w := week(office, allDays()...); w[time.Wednesday] = nil; return &w }()},
+		{"週一公休", &[7][]TimeRange{}},
+		{"18:00-02:00", func() *[7][]TimeRange { w := week(night, allDays()...); return &w }()},
+		{"24小時", func() *[7][]TimeRange { w := week(TimeRange{0, 24 * 60}, allDays()...); return &w }()},
+		{"請見粉絲專頁", nil},
+		{"", nil},
+	} {
+		h := parseOpeningHours(c.text)
+		if c.want == nil {
+			if h != nil {
+				t.Errorf("%q: got %+v, want nil", c.text, h.Days)
+			}
+			continue
+		}
+		want := *c.want
+		if h == nil {
+			t.Errorf("%q: got nil, want %+v", c.text, want)
+		} else if !reflect.DeepEqual(h.Days, want) {
+			t.Errorf("%q: got %+v, want %+v", c.text, h.Days, want)
+		}
+	}
+}
+
+func TestOpenAt(t *testing.T) {
+	for _, c := range []struct {
+		text string
+		t    time.Time
+		open bool
+	}{
+		{"週一至週五 08:00-18:00", at(time.Monday, 8, 0), true},
+		{"週一至週五 08:00-18:00", at(time.Monday, 17, 59), true},
+		{"週一至週五 08:00-18:00", at(time.Monday, 18, 0), false},
+		{"週一至週五 08:00-18:00", at(time.Saturday, 12, 0), false},
+		// closing past midnight opens the early hours of the next day
+		{"18:00-02:00", at(time.Tuesday, 1, 30), true},
+		{"18:00-02:00", at(time.Tuesday, 2, 0), false},
+		{"18:00-02:00", at(time.Tuesday, 12, 0), false},
+		{"18:00-02:00，週一公休", at(time.Tuesday, 1, 30), false},
+		{"18:00-02:00，週一公休", at(time.Sunday, 23, 0), true},
+		{"請見粉絲專頁", at(time.Monday, 12, 0), false},
+		// t in another zone is read in Taipei
+		{"週一至週五 08:00-18:00", at(time.Monday, 9, 0).UTC(), true},
+	} {
+		if got := parseOpeningHours(c.text).OpenAt(c.t); got != c.open {
+			t.Errorf("%q at %s: got open %v, want %v", c.text, c.t, got, c.open)
+		}
+	}
+}
+
+func TestToday(t *testing.T) {
+	for _, c := range []struct {
+		text string
+		t    time.Time
+		want string
+	}{
+		{"平日 8:00-18:00 假日 10:00-22:00", at(time.Wednesday, 12, 0), "今日 08:00-18:00"},
+		{"平日 8:00-18:00 假日 10:00-22:00", at(time.Sunday, 12, 0), "今日 10:00-22:00"},
+		{"每日 17:30-21:00, 11:00-14:00", at(time.Monday, 12, 0), "今日 11:00-14:00, 17:30-21:00"},
+		{"18:00-02:00", at(time.Friday, 12, 0), "今日 18:00-02:00"},
+		{"每日 08:00-18:00，週一公休", at(time.Monday, 12, 0), "今日公休"},
+		{"請見粉絲專頁", at(time.Monday, 12, 0), "營業時間未提供"},
+	} {
+		if got := parseOpeningHours(c.text).Today(c.t); got != c.want {
+			t.Errorf("%q on %s: got %q, want %q", c.text, c.t.Weekday(), got, c.want)
+		}
+	}
+}
+
+func TestOpeningHoursAreNotStored(t *testing.T) {
+	// cafes stored with their schedule come back from Firebase with the
+	// days off missing, as an object rather than an array
+	stored := `{"id": "weekend", "openTime": "週六、週日 10:00-22:00",
+		"hours": {"days": {"0": [{"open": 600, "close": 1320}], "6": [{"open": 600, "close": 1320}]}}}`
+	cafe := Cafe{}
+	if err := json.Unmarshal([]byte(stored), &cafe); err != nil {
+		t.Fatalf("can not read a cafe stored with hours: %s", err)
+	}
+	if h := cafe.openingHours(); h == nil || len(h.Days[time.Monday]) != 0 || len(h.Days[time.Sunday]) != 1 {
+		t.Errorf("got hours %+v", h)
+	}
+
+	b, err := json.Marshal(cafe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), `"hours"`) {
+		t.Errorf("the schedule was stored: %s", b)
+	}
+}
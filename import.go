@@ -0,0 +1,182 @@
+package cafehunter
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/urlfetch"
+)
+
+// importSummary tells what an import changed.
+type importSummary struct {
+	Fetched int
+	// Skipped are the fetched cafes that could not be read, e.g. for lack of
+	// valid coordinates, and have been left out.
+	Skipped []string
+	Added   []string
+	Updated []string
+	Removed []string
+	// Kept are the cafes edited by admins that differ from the fetched ones
+	// and have been left as edited.
+	Kept []string
+}
+
+func (s importSummary) String() string {
+	return fmt.Sprintf("fetched %d cafes, %d skipped: %d added, %d updated, %d removed, %d kept as edited",
+		s.Fetched, len(s.Skipped), len(s.Added), len(s.Updated), len(s.Removed), len(s.Kept))
+}
+
+// openCafeSource opens the cafenomad data at an http(s) URL or, for local
+// runs and fixtures, at a file path.
+func openCafeSource(ctx context.Context, source string) (io.ReadCloser, error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		return os.Open(source)
+	}
+
+	resp, err := urlfetch.Client(ctx).Get(source)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// fetchNomadCafes downloads and decodes the cafes published by cafenomad,
+// returning the ids of those that could not be decoded as skipped.
+func fetchNomadCafes(ctx context.Context, source string) (cafes []Cafe, skipped []string, err error) {
+	r, err := openCafeSource(ctx, source)
+	if err != nil {
+		return nil, nil, fmt.Errorf("can not fetch cafes from %s: %s", source, err)
+	}
+	defer r.Close()
+
+	cafes, skipped, err = decodeNomadCafes(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("can not decode cafes from %s: %s", source, err)
+	}
+	return cafes, skipped, nil
+}
+
+// diffCafes compares the stored cafes with freshly fetched ones and returns
+// the cafes to write and the ids to remove. Cafes edited by admins are never
+// overwritten, and neither they nor cafes from other sources than cafenomad
+// are ever removed. The skipped cafes were fetched but could not be read, so
+// they are left as stored.
+func diffCafes(stored, fetched []Cafe, skipped []string) (put []Cafe, summary importSummary) {
+	old := map[string]Cafe{}
+	for _, cafe := range stored {
+		old[cafe.Id] = cafe
+	}
+
+	seen := map[string]bool{}
+	for _, id := range skipped {
+		if !seen[id] {
+			seen[id] = true
+			summary.Skipped = append(summary.Skipped, id)
+		}
+	}
+	for _, cafe := range fetched {
+		if seen[cafe.Id] {
+			continue
+		}
+		seen[cafe.Id] = true
+
+		o, ok := old[cafe.Id]
+		switch {
+		case !ok:
+			summary.Added = append(summary.Added, cafe.Id)
+		case o.EditedAt != nil:
+			if !sameCafe(o, cafe) {
+				summary.Kept = append(summary.Kept, cafe.Id)
+			}
+			continue
+		case !sameCafe(o, cafe):
+			summary.Updated = append(summary.Updated, cafe.Id)
+		default:
+			continue
+		}
+		put = append(put, cafe)
+	}
+
+	for id, cafe := range old {
+		if !seen[id] && cafe.Source == "" && cafe.EditedAt == nil {
+			summary.Removed = append(summary.Removed, id)
+		}
+	}
+	sort.Strings(summary.Removed)
+	sort.Strings(summary.Kept)
+	summary.Fetched = len(seen)
+	return
+}
+
+// sameCafe compares the stored fields of two cafes.
+func sameCafe(a, b Cafe) bool {
+	a.Distance, b.Distance = 0, 0
+	a.Detour, b.Detour = 0, 0
+	return reflect.DeepEqual(a, b)
+}
+
+// importCafes brings the repository in line with the cafes at source. It
+// refuses an empty source, which is more likely a broken download than
+// every cafe closing at once. Cafes at source that can not be read are
+// skipped; stored ones with the same id are kept.
+func importCafes(ctx context.Context, repo CafeRepository, source string, dryRun bool) (summary importSummary, err error) {
+	fetched, skipped, err := fetchNomadCafes(ctx, source)
+	if err != nil {
+		return
+	}
+	if len(fetched) == 0 {
+		return summary, fmt.Errorf("can not import an empty cafe list from %s", source)
+	}
+
+	stored, err := repo.All(ctx)
+	if err != nil {
+		return summary, fmt.Errorf("can not read stored cafes: %s", err)
+	}
+
+	put, summary := diffCafes(stored, fetched, skipped)
+	if dryRun || (len(put) == 0 && len(summary.Removed) == 0) {
+		return
+	}
+	err = repo.Update(ctx, put, summary.Removed)
+	return
+}
+
+// importCafesHandler runs an import from cfg.CafeNomadURL, or only reports
+// what it would change with ?dryRun=true.
+func importCafesHandler(cfg *Config, w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	dryRun := r.FormValue("dryRun") == "true"
+
+	summary, err := importCafes(ctx, cafeRepo, cfg.CafeNomadURL, dryRun)
+	if err != nil {
+		log.Errorf(ctx, "can not import cafes: %s", err)
+		http.Error(w, "unable to import cafes", http.StatusInternalServerError)
+		return
+	}
+
+	log.Infof(ctx, "cafe import: %s", summary)
+	if dryRun {
+		fmt.Fprint(w, "dry run, nothing written\n")
+	}
+	fmt.Fprintf(w, "%s\n", summary)
+	for _, list := range []struct {
+		title string
+		ids   []string
+	}{{"skipped", summary.Skipped}, {"added", summary.Added}, {"updated", summary.Updated}, {"removed", summary.Removed}, {"kept", summary.Kept}} {
+		if len(list.ids) > 0 {
+			fmt.Fprintf(w, "%s: %s\n", list.title, strings.Join(list.ids, ", "))
+		}
+	}
+}
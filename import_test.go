@@ -0,0 +1,192 @@
+package cafehunter
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const SAMPLE_CAFES = "data/cafes.sample.json"
+
+// sampleCafes returns the cafes of the sample fixture by id.
+func sampleCafes(t *testing.T) map[string]Cafe {
+	f, err := os.Open(SAMPLE_CAFES)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	cafes, skipped, err := decodeNomadCafes(f)
+	if err != nil || len(skipped) > 0 {
+		t.Fatalf("can not decode %s: %v, skipped %v", SAMPLE_CAFES, err, skipped)
+	}
+	byId := map[string]Cafe{}
+	for _, c := range cafes {
+		byId[c.Id] = c
+	}
+	return byId
+}
+
+// writeCafes writes a cafenomad document to a file removed by the returned
+// function.
+func writeCafes(t *testing.T, doc string) (string, func()) {
+	f, err := ioutil.TempFile("", "cafes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(doc); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name(), func() { os.Remove(f.Name()) }
+}
+
+func storedIds(t *testing.T, repo CafeRepository) []string {
+	cafes, err := repo.All(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []string{}
+	for _, c := range cafes {
+		ids = append(ids, c.Id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestDecodeNomadCafesSkipsInvalid(t *testing.T) {
+	cafes, skipped, err := decodeNomadCafes(strings.NewReader(`[
+		{"id": "good", "name": "好咖啡", "latitude": "25.0430", "longitude": "121.5070"},
+		{"id": "no-latitude", "name": "沒有緯度", "latitude": "", "longitude": "121.5070"},
+		{"id": "bad-longitude", "name": "經度錯誤", "latitude": "25.0430", "longitude": "121,5070"}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cafes) != 1 || cafes[0].Id != "good" {
+		t.Errorf("got cafes %+v, want only good", cafes)
+	}
+	if want := []string{"no-latitude", "bad-longitude"}; !reflect.DeepEqual(skipped, want) {
+		t.Errorf("got skipped %v, want %v", skipped, want)
+	}
+
+	if _, _, err := decodeNomadCafes(strings.NewReader(`{"id": "not an array"}`)); err == nil {
+		t.Error("a malformed document was decoded")
+	}
+}
+
+func TestImportCafes(t *testing.T) {
+	ctx := context.Background()
+	sample := sampleCafes(t)
+	edited := time.Date(2026, 1, 2, 3, 4, 5, 0, taipei)
+
+	renamed := sample["sample-ximen-01"]
+	renamed.Name = "西門舊名咖啡"
+	editedByAdmin := sample["sample-zhongshan-01"]
+	editedByAdmin.Quiet = 1
+	editedByAdmin.EditedAt = &edited
+	stored := []Cafe{
+		renamed,
+		editedByAdmin,
+		{Id: "closed-01", Name: "已歇業咖啡"},
+		{Id: "user-01", Name: "網友新增咖啡", Source: "user"},
+		{Id: "admin-01", Name: "管理員新增咖啡", Source: "admin", EditedAt: &edited},
+	}
+
+	// a dry run reports the changes without making them
+	repo := newMemoryCafeRepository(append([]Cafe{}, stored...))
+	summary, err := importCafes(ctx, repo, SAMPLE_CAFES, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := importSummary{
+		Fetched: 3,
+		Added:   []string{"sample-station-01"},
+		Updated: []string{"sample-ximen-01"},
+		Removed: []string{"closed-01"},
+		Kept:    []string{"sample-zhongshan-01"},
+	}
+	if !reflect.DeepEqual(summary, want) {
+		t.Errorf("dry run: got %+v, want %+v", summary, want)
+	}
+	if ids := storedIds(t, repo); len(ids) != len(stored) {
+		t.Errorf("dry run changed the cafes to %v", ids)
+	}
+	if c, _ := repo.ByID(ctx, "sample-ximen-01"); c.Name != renamed.Name {
+		t.Errorf("dry run updated %s", c.Id)
+	}
+
+	summary, err = importCafes(ctx, repo, SAMPLE_CAFES, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(summary, want) {
+		t.Errorf("import: got %+v, want %+v", summary, want)
+	}
+	wantIds := []string{"admin-01", "sample-station-01", "sample-ximen-01", "sample-zhongshan-01", "user-01"}
+	if ids := storedIds(t, repo); !reflect.DeepEqual(ids, wantIds) {
+		t.Errorf("got cafes %v, want %v", ids, wantIds)
+	}
+	for id, want := range map[string]Cafe{
+		"sample-station-01":   sample["sample-station-01"],
+		"sample-ximen-01":     sample["sample-ximen-01"],
+		"sample-zhongshan-01": editedByAdmin,
+	} {
+		if c, _ := repo.ByID(ctx, id); c == nil || !sameCafe(*c, want) {
+			t.Errorf("%s: got %+v, want %+v", id, c, want)
+		}
+	}
+
+	// importing the same cafes again changes nothing
+	summary, err = importCafes(ctx, repo, SAMPLE_CAFES, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (importSummary{Fetched: 3, Kept: []string{"sample-zhongshan-01"}}); !reflect.DeepEqual(summary, want) {
+		t.Errorf("second import: got %+v, want %+v", summary, want)
+	}
+}
+
+func TestImportCafesKeepsSkipped(t *testing.T) {
+	source, remove := writeCafes(t, `[
+		{"id": "sample-ximen-01", "name": "西門範例咖啡", "latitude": "", "longitude": ""},
+		{"id": "new-01", "name": "新咖啡", "latitude": "25.0400", "longitude": "121.5000"}
+	]`)
+	defer remove()
+
+	ctx := context.Background()
+	sample := sampleCafes(t)
+	repo := newMemoryCafeRepository([]Cafe{sample["sample-ximen-01"]})
+	summary, err := importCafes(ctx, repo, source, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := importSummary{Fetched: 2, Skipped: []string{"sample-ximen-01"}, Added: []string{"new-01"}}
+	if !reflect.DeepEqual(summary, want) {
+		t.Errorf("got %+v, want %+v", summary, want)
+	}
+	if c, _ := repo.ByID(ctx, "sample-ximen-01"); c == nil || !sameCafe(*c, sample["sample-ximen-01"]) {
+		t.Errorf("a skipped cafe was changed to %+v", c)
+	}
+}
+
+func TestImportCafesRefusesEmptySource(t *testing.T) {
+	source, remove := writeCafes(t, `[{"id": "bad-01", "name": "沒有座標", "latitude": "", "longitude": ""}]`)
+	defer remove()
+
+	ctx := context.Background()
+	sample := sampleCafes(t)
+	repo := newMemoryCafeRepository([]Cafe{sample["sample-ximen-01"]})
+	if _, err := importCafes(ctx, repo, source, false); err == nil {
+		t.Error("a source without a readable cafe was imported")
+	}
+	if ids := storedIds(t, repo); len(ids) != 1 {
+		t.Errorf("got cafes %v after a refused import", ids)
+	}
+}
@@ -0,0 +1,52 @@
+package cafehunter
+
+import "sync"
+
+// keyedMutex serializes work sharing the same key while work on different
+// keys runs concurrently. Unused keys are released so the map stays small.
+//
+// The locks live in the memory of one instance. When App Engine runs several
+// instances, two messages of the same user handled by different instances
+// still race, and the session saved last wins.
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	sync.Mutex
+	refs int
+}
+
+func newKeyedMutex() *keyedMutex {
+	return &keyedMutex{locks: map[string]*keyedLock{}}
+}
+
+func (k *keyedMutex) Lock(key string) {
+	k.mu.Lock()
+	l, ok := k.locks[key]
+	if !ok {
+		l = &keyedLock{}
+		k.locks[key] = l
+	}
+	l.refs++
+	k.mu.Unlock()
+
+	l.Lock()
+}
+
+func (k *keyedMutex) Unlock(key string) {
+	k.mu.Lock()
+	l, ok := k.locks[key]
+	if !ok {
+		k.mu.Unlock()
+		panic("cafehunter: unlock of unlocked key " + key)
+	}
+	l.refs--
+	if l.refs == 0 {
+		delete(k.locks, key)
+	}
+	k.mu.Unlock()
+
+	l.Unlock()
+}
@@ -7,10 +7,6 @@ import (
 	"net/url"
 )
 
-const LUIS_URL = "api.projectoxford.ai"
-const APP_ID = ""
-const APP_KEY = ""
-
 type Intent struct {
 	Intent string  `json:"intent"`
 	Score  float64 `json:"score"`
@@ -28,7 +24,9 @@ type LuisResult struct {
 	Entities         []Entity `json:"entities"`
 }
 
-func fetchIntent(request func(*http.Request) (*http.Response, error), query string, verbose bool) (r LuisResult, err error) {
+// fetchIntent asks the LUIS application of cfg for the intent and entities
+// of a query, sending the request with request.
+func fetchIntent(cfg *Config, request func(*http.Request) (*http.Response, error), query string, verbose bool) (r LuisResult, err error) {
 	v := "false"
 	if verbose {
 		v = "true"
@@ -36,9 +34,9 @@ func fetchIntent(request func(*http.Request) (*http.Response, error), query stri
 
 	u := url.URL{
 		Scheme:   "https",
-		Host:     LUIS_URL,
-		Path:     fmt.Sprintf("/luis/v2.0/apps/%s", APP_ID),
-		RawQuery: fmt.Sprintf("subscription-key=%s&q=%s&verbose=%s", APP_KEY, url.QueryEscape(query), v),
+		Host:     cfg.LuisURL,
+		Path:     fmt.Sprintf("/luis/v2.0/apps/%s", cfg.LuisAppID),
+		RawQuery: fmt.Sprintf("subscription-key=%s&q=%s&verbose=%s", cfg.LuisAppKey, url.QueryEscape(query), v),
 	}
 
 	req, err := http.NewRequest("GET", u.String(), nil)
@@ -46,10 +44,13 @@ func fetchIntent(request func(*http.Request) (*http.Response, error), query stri
 		return
 	}
 	resp, err := request(req)
-	if resp.StatusCode != 200 {
+	if err != nil {
 		return
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return r, fmt.Errorf("unexpected status %s", resp.Status)
+	}
 
 	d := json.NewDecoder(resp.Body)
 	err = d.Decode(&r)
@@ -0,0 +1,458 @@
+package cafehunter
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/lemonlatte/ambassador"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/log"
+)
+
+// MAX_LINE_STATIONS bounds how many stations a search along a line covers,
+// which keeps the cells read for a search and the list of stations sent
+// before the cafes short.
+const MAX_LINE_STATIONS = 11
+
+type metroStation struct {
+	Code      string  `json:"code"`
+	Name      string  `json:"name"`
+	Latitude  float64 `json:"lat"`
+	Longitude float64 `json:"lng"`
+}
+
+// key identifies a station across lines and systems. Stations shared by the
+// lines of different systems, such as 台北車站 of 台北捷運 and 桃園捷運, have
+// the same name and coordinates.
+func (s metroStation) key() string {
+	return fmt.Sprintf("%s@%.4f,%.4f", s.Name, s.Latitude, s.Longitude)
+}
+
+// stationName returns how a station is called, e.g. "中山站" for "中山" and
+// "台北車站" for "台北車站", which already ends with 站.
+func stationName(name string) string {
+	if strings.HasSuffix(name, "站") {
+		return name
+	}
+	return name + "站"
+}
+
+// names returns the station name and its parts, e.g. "台北101" and "世貿"
+// for "台北101/世貿".
+func (s metroStation) names() []string {
+	names := []string{s.Name}
+	if strings.Contains(s.Name, "/") {
+		names = append(names, strings.Split(s.Name, "/")...)
+	}
+	return names
+}
+
+// metroLine is a metro line with its stations in order.
+type metroLine struct {
+	Id       string         `json:"id"`
+	Name     string         `json:"name"`
+	Aliases  []string       `json:"aliases"`
+	System   string         `json:"system"`
+	Stations []metroStation `json:"stations"`
+}
+
+// stationIndex returns the position of the first station on the line named
+// in text, or -1.
+func (l *metroLine) stationIndex(text string) int {
+	for i, s := range l.Stations {
+		for _, name := range s.names() {
+			if name == text {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// segment returns the indexes of the first two stations of the line named
+// in text, in the order they are mentioned.
+func (l *metroLine) segment(text string) (from, to int, ok bool) {
+	// line names may hold station names, as 淡水 in 淡水信義線
+	for _, name := range append([]string{l.Name}, l.Aliases...) {
+		text = strings.Replace(text, name, " ", -1)
+	}
+
+	type mention struct{ at, end, index int }
+	mentions := []mention{}
+	for i, s := range l.Stations {
+		for _, name := range s.names() {
+			if at := strings.Index(text, name); at >= 0 {
+				mentions = append(mentions, mention{at, at + len(name), i})
+				break
+			}
+		}
+	}
+
+	// drop names found inside longer ones, e.g. 大安 in 大安森林公園
+	found := []mention{}
+	for _, m := range mentions {
+		inside := false
+		for _, n := range mentions {
+			if n.at <= m.at && m.end <= n.end && n.end-n.at > m.end-m.at {
+				inside = true
+				break
+			}
+		}
+		if !inside {
+			found = append(found, m)
+		}
+	}
+	if len(found) < 2 {
+		return 0, 0, false
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].at < found[j].at })
+	return found[0].index, found[1].index, true
+}
+
+// between returns the stations from one index to another, in that order.
+func (l *metroLine) between(from, to int) []metroStation {
+	stations := []metroStation{}
+	if from <= to {
+		stations = append(stations, l.Stations[from:to+1]...)
+	} else {
+		for i := from; i >= to; i-- {
+			stations = append(stations, l.Stations[i])
+		}
+	}
+	return stations
+}
+
+// metroCatalogue holds the metro lines of Taipei, Kaohsiung and Taoyuan.
+type metroCatalogue struct {
+	Lines []metroLine
+}
+
+var metro *metroCatalogue
+
+func loadMetro(path string) (*metroCatalogue, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	m := &metroCatalogue{}
+	if err := json.NewDecoder(f).Decode(&m.Lines); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// line returns the line of an id, or nil.
+func (m *metroCatalogue) line(id string) *metroLine {
+	for i := range m.Lines {
+		if m.Lines[i].Id == id {
+			return &m.Lines[i]
+		}
+	}
+	return nil
+}
+
+// gazetteerEntries lists every station once, even when it is served by
+// several lines or systems.
+func (m *metroCatalogue) gazetteerEntries() []gazetteerEntry {
+	entries := []gazetteerEntry{}
+	seen := map[string]bool{}
+	for _, l := range m.Lines {
+		for _, s := range l.Stations {
+			if seen[s.key()] {
+				continue
+			}
+			seen[s.key()] = true
+
+			names := s.names()
+			entries = append(entries, gazetteerEntry{
+				Name:      s.Name,
+				Aliases:   names[1:],
+				Kind:      "mrt",
+				City:      l.System,
+				Latitude:  s.Latitude,
+				Longitude: s.Longitude,
+			})
+		}
+	}
+	return entries
+}
+
+// Geocode answers queries naming a station exactly, such as "古亭站",
+// "台北車站" or "捷運忠孝復興", so stations win over similarly named places
+// Google finds.
+func (m *metroCatalogue) Geocode(ctx context.Context, query string) ([]Place, error) {
+	q := normalizePlaceName(query)
+
+	places := []Place{}
+	seen := map[string]bool{}
+	for _, l := range m.Lines {
+		i := l.stationIndex(q)
+		if i < 0 {
+			i = l.stationIndex(strings.TrimSuffix(q, "站"))
+		}
+		if i < 0 || seen[l.Stations[i].key()] {
+			continue
+		}
+		seen[l.Stations[i].key()] = true
+
+		s := l.Stations[i]
+		places = append(places, gazetteerEntry{
+			Name:      s.Name,
+			Kind:      "mrt",
+			City:      l.System,
+			Latitude:  s.Latitude,
+			Longitude: s.Longitude,
+		}.place())
+	}
+	return places, nil
+}
+
+// findLine returns the line whose name or alias is the longest one found in
+// text, or nil.
+func (m *metroCatalogue) findLine(text string) *metroLine {
+	var found *metroLine
+	longest := 0
+	for i := range m.Lines {
+		l := &m.Lines[i]
+		for _, name := range append([]string{l.Name}, l.Aliases...) {
+			if len(name) > longest && strings.Contains(text, name) {
+				found, longest = l, len(name)
+			}
+		}
+	}
+	return found
+}
+
+// lineQuery is a search for the cafes along a segment of a metro line, From
+// and To being indexes of its stations, carried in postback payloads like
+// cafeQuery.
+type lineQuery struct {
+	Line     string
+	From     int
+	To       int
+	Filter   CafeFilter
+	Profile  string
+	Offset   int
+	PageSize int
+}
+
+func (q lineQuery) pageSize() int {
+	return cafeQuery{PageSize: q.PageSize}.pageSize()
+}
+
+// payload encodes the query after command as "COMMAND:line:from,to[:options]".
+func (q lineQuery) payload(command string) string {
+	p := fmt.Sprintf("%s:%s:%d,%d", command, q.Line, q.From, q.To)
+
+	options := url.Values{}
+	if len(q.Filter) > 0 {
+		options.Set("f", q.Filter.String())
+	}
+	if q.Profile != "" {
+		options.Set("p", q.Profile)
+	}
+	if q.Offset > 0 {
+		options.Set("o", strconv.Itoa(q.Offset))
+	}
+	if q.PageSize > 0 {
+		options.Set("n", strconv.Itoa(q.PageSize))
+	}
+	if len(options) > 0 {
+		p += ":" + options.Encode()
+	}
+	return p
+}
+
+// parseLineQuery decodes the arguments following the command of a payload
+// written by lineQuery.payload.
+func parseLineQuery(args []string) (q lineQuery, err error) {
+	if len(args) < 2 {
+		return q, fmt.Errorf("missing line or stations")
+	}
+	q.Line = args[0]
+
+	ends := strings.Split(args[1], ",")
+	if len(ends) != 2 {
+		return q, fmt.Errorf("invalid stations: %s", args[1])
+	}
+	if q.From, err = strconv.Atoi(ends[0]); err != nil {
+		return
+	}
+	if q.To, err = strconv.Atoi(ends[1]); err != nil {
+		return
+	}
+
+	if len(args) > 2 {
+		var options url.Values
+		if options, err = url.ParseQuery(args[2]); err != nil {
+			return
+		}
+		q.Filter = parseCafeFilter(options.Get("f"))
+		if p := findScoringProfile(options.Get("p")); p != nil {
+			q.Profile = p.Name
+		}
+		if o := options.Get("o"); o != "" {
+			if q.Offset, err = strconv.Atoi(o); err != nil {
+				return
+			}
+		}
+		if n := options.Get("n"); n != "" {
+			if q.PageSize, err = strconv.Atoi(n); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// stationCafes are the cafes of a search along a line nearest to a station.
+type stationCafes struct {
+	Station metroStation
+	Cafes   []Cafe
+}
+
+// findCafeAlongLine returns the cafes matching filter near each station, in
+// the order of the stations. The cells around every station are read at
+// once, neighbouring stations sharing most of them. A cafe near several
+// stations is only listed at the nearest one. The cafes of a station are
+// nearest first, or ranked with the scoring profile of the given name.
+func findCafeAlongLine(ctx context.Context, stations []metroStation, filter CafeFilter, profile string) ([]stationCafes, error) {
+	radius := config.SearchRadius
+	seen := map[string]bool{}
+	cells := []string{}
+	for _, s := range stations {
+		for _, c := range nearbyCells(s.Latitude, s.Longitude, radius) {
+			if !seen[c] {
+				seen[c] = true
+				cells = append(cells, c)
+			}
+		}
+	}
+	all, err := cafeRepo.InCells(ctx, cells)
+	if err != nil {
+		return nil, fmt.Errorf("can not fetch cafes along the line: %s", err)
+	}
+	all = filter.Apply(all)
+
+	found := make([][]Cafe, len(stations))
+	nearest := map[string]int{}
+	nearestDistance := map[string]float64{}
+	for i, s := range stations {
+		found[i] = rankByDistance(all, s.Latitude, s.Longitude, radius)
+		for _, c := range found[i] {
+			if d, ok := nearestDistance[c.Id]; !ok || c.Distance < d {
+				nearest[c.Id], nearestDistance[c.Id] = i, c.Distance
+			}
+		}
+	}
+
+	p := findScoringProfile(profile)
+	groups := make([]stationCafes, len(stations))
+	for i, s := range stations {
+		groups[i].Station = s
+		for _, c := range found[i] {
+			if nearest[c.Id] == i {
+				groups[i].Cafes = append(groups[i].Cafes, c)
+			}
+		}
+		if p != nil {
+			groups[i].Cafes = rankCafes(groups[i].Cafes, *p)
+		}
+	}
+	return groups, nil
+}
+
+// replyCafesAlongLine sends the page of the cafes along a segment of a line
+// starting at the query offset, grouped by station with the station before
+// the name of each cafe. The first page comes with the number of cafes near
+// each station.
+func replyCafesAlongLine(ctx context.Context, a ambassador.Ambassador, senderId string, q lineQuery) (err error) {
+	line := metro.line(q.Line)
+	if line == nil || q.From < 0 || q.To < 0 || q.From >= len(line.Stations) || q.To >= len(line.Stations) {
+		return a.SendText(senderId, "查詢錯誤")
+	}
+	stations := line.between(q.From, q.To)
+
+	groups, err := findCafeAlongLine(ctx, stations, q.Filter, q.Profile)
+	if err != nil {
+		log.Errorf(ctx, "%s", err)
+		return a.SendText(senderId, "查詢咖啡店時發生錯誤，請稍後再試")
+	}
+
+	kind := "咖啡店"
+	if len(q.Filter) > 0 {
+		kind = fmt.Sprintf("%s的咖啡店", q.Filter.Description())
+	}
+	lines := []string{fmt.Sprintf("%s %s → %s 沿線的%s：", line.Name,
+		stationName(stations[0].Name), stationName(stations[len(stations)-1].Name), kind)}
+	cafes := []Cafe{}
+	for _, g := range groups {
+		lines = append(lines, fmt.Sprintf("%s %d 家", stationName(g.Station.Name), len(g.Cafes)))
+		for _, c := range g.Cafes {
+			c.Name = fmt.Sprintf("[%s] %s", stationName(g.Station.Name), c.Name)
+			cafes = append(cafes, c)
+		}
+	}
+	cafes = withReviews(ctx, cafes, q.Offset, q.pageSize())
+
+	_, items, n := cafeToFBTemplate(cafes, q.Offset, q.pageSize(), searchResultButtons)
+	if n == 0 {
+		return a.SendText(senderId, strings.Join(lines, "\n")+"\n這段沿線沒有我知道的"+kind+"。")
+	}
+	if q.Offset >= n {
+		return a.SendText(senderId, "沒有更多咖啡店了。")
+	}
+	if q.Offset == 0 {
+		if err = a.SendText(senderId, strings.Join(lines, "\n")); err != nil {
+			return
+		}
+	}
+	if err = a.SendTemplate(senderId, items); err != nil {
+		return
+	}
+
+	if next := q.Offset + q.pageSize(); next < n {
+		more := q
+		more.Offset = next
+		err = a.AskQuestion(senderId, "還有更多咖啡店", []map[string]string{
+			map[string]string{
+				"content_type": "text",
+				"title":        "看更多",
+				"payload":      more.payload("FIND_CAFE_LINE"),
+			},
+		})
+	}
+	return
+}
+
+// lineSearchHandler answers requests such as "板南線西門到市政府沿線的咖啡店"
+// with the cafes near the stations of the segment, grouped by station.
+func lineSearchHandler(ctx context.Context, user *User, message string, a ambassador.Ambassador) (err error) {
+	line := metro.findLine(message)
+	if line == nil {
+		return a.SendText(user.Id, "請告訴我是哪一條捷運線，例如「板南線西門到市政府沿線」")
+	}
+	from, to, ok := line.segment(message)
+	if !ok {
+		return a.SendText(user.Id, fmt.Sprintf("請告訴我要從%s哪一站到哪一站，例如「%s%s到%s沿線」",
+			line.Name, line.Name, line.Stations[0].Name, line.Stations[len(line.Stations)-1].Name))
+	}
+	if len(line.between(from, to)) > MAX_LINE_STATIONS {
+		return a.SendText(user.Id, fmt.Sprintf("範圍太大了，請縮小到 %d 站以內", MAX_LINE_STATIONS))
+	}
+
+	user.Filter = filterFromText(message)
+	user.Profile = profileFromText(message)
+	q := lineQuery{Line: line.Id, From: from, To: to, Filter: user.Filter, Profile: user.Profile}
+	if q.Profile == "" {
+		q.Profile = user.Preferences.Profile
+	}
+	return replyCafesAlongLine(ctx, a, user.Id, user.applyLinePreferences(q))
+}
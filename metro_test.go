@@ -0,0 +1,109 @@
+package cafehunter
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/aetest"
+)
+
+func testMetro(t *testing.T) *metroCatalogue {
+	m, err := loadMetro(testConfig().MetroFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestStationName(t *testing.T) {
+	for name, want := range map[string]string{"中山": "中山站", "台北車站": "台北車站", "台北101/世貿": "台北101/世貿站"} {
+		if got := stationName(name); got != want {
+			t.Errorf("stationName(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestMetroGeocodeSharedStations(t *testing.T) {
+	m := testMetro(t)
+	g := newGazetteer(m.gazetteerEntries())
+
+	// 台北車站 and 三重 are served by 台北捷運 and 桃園捷運
+	for _, c := range []struct {
+		query, name, address string
+	}{
+		{"台北車站", "捷運台北車站", "台北捷運台北車站"},
+		{"捷運台北車站附近", "捷運台北車站", "台北捷運台北車站"},
+		{"三重站", "捷運三重站", "台北捷運三重站"},
+		{"古亭", "捷運古亭站", "台北捷運古亭站"},
+	} {
+		for _, geocoder := range []Geocoder{m, g} {
+			places, err := geocoder.Geocode(context.Background(), c.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(places) != 1 {
+				t.Errorf("%T %s: got %d places %+v, want 1", geocoder, c.query, len(places), places)
+				continue
+			}
+			if places[0].Name != c.name || places[0].FormattedAddress != c.address {
+				t.Errorf("%T %s: got %s at %s, want %s at %s", geocoder, c.query,
+					places[0].Name, places[0].FormattedAddress, c.name, c.address)
+			}
+		}
+	}
+}
+
+func TestLineQueryPayload(t *testing.T) {
+	q := lineQuery{Line: "BL", From: 10, To: 12, Filter: parseCafeFilter("wifi"), Profile: "work", Offset: 10, PageSize: 5}
+	payload := q.payload("FIND_CAFE_LINE")
+	if !strings.HasPrefix(payload, "FIND_CAFE_LINE:BL:10,12:") {
+		t.Errorf("got payload %s", payload)
+	}
+	got, err := parseLineQuery(strings.Split(payload, ":")[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, q) {
+		t.Errorf("got %+v, want %+v", got, q)
+	}
+}
+
+func TestLineSearchGroupsCafesByStation(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	defer useSampleCafes(t)()
+	repo := &countingRepository{CafeRepository: cafeRepo}
+	cafeRepo = repo
+	savedMetro := metro
+	metro = testMetro(t)
+	defer func() { metro = savedMetro }()
+
+	a := newFakeAmbassador()
+	user := newUser("user")
+	if err := lineSearchHandler(ctx, user, "板南線西門到台北車站沿線的咖啡店", a); err != nil {
+		t.Fatal(err)
+	}
+	// the cells around both stations are read at once
+	if repo.inCells != 1 || repo.nearby != 0 {
+		t.Errorf("read cells %d times and surroundings %d times, want cells once", repo.inCells, repo.nearby)
+	}
+
+	sent := a.texts("user")
+	if len(sent) != 2 {
+		t.Fatalf("got %d messages %q, want the stations and the cafes", len(sent), sent)
+	}
+	if want := "板南線 西門站 → 台北車站 沿線的咖啡店：\n西門站 1 家\n台北車站 1 家"; sent[0] != want {
+		t.Errorf("got %q, want %q", sent[0], want)
+	}
+	ximen := strings.Index(sent[1], `"title":"[西門站] 西門範例咖啡"`)
+	station := strings.Index(sent[1], `"title":"[台北車站] 車站範例咖啡"`)
+	if ximen < 0 || station < ximen {
+		t.Errorf("the cafes are not grouped by station in order: %s", sent[1])
+	}
+}
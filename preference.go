@@ -0,0 +1,398 @@
+package cafehunter
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/lemonlatte/ambassador"
+	"github.com/looplab/fsm"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/log"
+)
+
+// savedPlace is a location a user named, such as home.
+type savedPlace struct {
+	Name      string  `json:"name"`
+	Latitude  float64 `json:"lat"`
+	Longitude float64 `json:"lng"`
+}
+
+// Preferences are what a user wants from every search: attributes cafes
+// must have, how to rank them, how many to show at a time, and the places
+// the user searches around most.
+type Preferences struct {
+	Filter   CafeFilter  `json:"filter,omitempty"`
+	Profile  string      `json:"profile,omitempty"`
+	PageSize int         `json:"pageSize,omitempty"`
+	Home     *savedPlace `json:"home,omitempty"`
+	Work     *savedPlace `json:"work,omitempty"`
+}
+
+func (p Preferences) pageSize() int {
+	return cafeQuery{PageSize: p.PageSize}.pageSize()
+}
+
+// place returns the saved place of a kind, "home" or "work".
+func (p *Preferences) place(kind string) **savedPlace {
+	if kind == "work" {
+		return &p.Work
+	}
+	return &p.Home
+}
+
+var savedPlaceTitles = map[string]string{"home": "家", "work": "公司"}
+
+// newQuery builds a query for the cafes around a point with the filter and
+// profile asked for in the conversation, on top of the user preferences.
+func (user *User) newQuery(lat, lng float64) cafeQuery {
+	q := cafeQuery{
+		Latitude:  lat,
+		Longitude: lng,
+		Filter:    user.Filter,
+		Profile:   user.Profile,
+	}
+	if q.Profile == "" {
+		q.Profile = user.Preferences.Profile
+	}
+	return user.applyPreferences(q)
+}
+
+// applyPreferences adds the attributes the user always wants and the page
+// size to a query, such as one decoded from a postback. The profile is left
+// alone since a postback may ask for cafes nearest first on purpose.
+func (user *User) applyPreferences(q cafeQuery) cafeQuery {
+	q.Filter = q.Filter.merge(user.Preferences.Filter)
+	if q.PageSize == 0 {
+		q.PageSize = user.Preferences.PageSize
+	}
+	return q
+}
+
+// applyRoutePreferences is applyPreferences for a search along a route.
+func (user *User) applyRoutePreferences(q routeQuery) routeQuery {
+	q.Filter = q.Filter.merge(user.Preferences.Filter)
+	if q.PageSize == 0 {
+		q.PageSize = user.Preferences.PageSize
+	}
+	return q
+}
+
+// applyLinePreferences is applyPreferences for a search along a metro line.
+func (user *User) applyLinePreferences(q lineQuery) lineQuery {
+	q.Filter = q.Filter.merge(user.Preferences.Filter)
+	if q.PageSize == 0 {
+		q.PageSize = user.Preferences.PageSize
+	}
+	return q
+}
+
+var savedPlaceKeywords = map[string][]string{
+	"home": {"家附近", "家裡附近", "住家附近"},
+	"work": {"公司附近", "辦公室附近"},
+}
+
+// savedPlaceInText returns the kind of saved place a message asks about,
+// e.g. "home" for "家裡附近的咖啡店".
+func savedPlaceInText(text string) (string, bool) {
+	for _, kind := range []string{"home", "work"} {
+		for _, k := range savedPlaceKeywords[kind] {
+			if strings.Contains(text, k) {
+				return kind, true
+			}
+		}
+	}
+	return "", false
+}
+
+// savedPlaceReplies offers the saved places of a user as quick replies
+// searching around them.
+func savedPlaceReplies(user *User) []map[string]string {
+	replies := []map[string]string{}
+	for _, kind := range []string{"home", "work"} {
+		if p := *user.Preferences.place(kind); p != nil {
+			replies = append(replies, map[string]string{
+				"content_type": "text",
+				"title":        savedPlaceTitles[kind] + "附近",
+				"payload":      user.newQuery(p.Latitude, p.Longitude).payload("FIND_CAFE_GEOCODING"),
+			})
+		}
+	}
+	return replies
+}
+
+// replySavedPlace searches around a saved place, or tells the user how to
+// save it.
+func replySavedPlace(ctx context.Context, a ambassador.Ambassador, user *User, kind string) error {
+	p := *user.Preferences.place(kind)
+	if p == nil {
+		return a.SendText(user.Id, fmt.Sprintf("你還沒有設定%s的位置，說「設定」就可以設定喔。", savedPlaceTitles[kind]))
+	}
+	user.LastText = savedPlaceTitles[kind] + "附近"
+	return searchNearby(ctx, a, user, user.newQuery(p.Latitude, p.Longitude))
+}
+
+// preferencesText describes the preferences of a user.
+func preferencesText(p Preferences) string {
+	filter := "無"
+	if len(p.Filter) > 0 {
+		filter = p.Filter.Description()
+	}
+	profile := "距離"
+	if sp := findScoringProfile(p.Profile); sp != nil {
+		profile = sp.Title
+	}
+	places := map[string]string{}
+	for _, kind := range []string{"home", "work"} {
+		places[kind] = "未設定"
+		if sp := *p.place(kind); sp != nil {
+			places[kind] = sp.Name
+		}
+	}
+	return strings.Join([]string{
+		"目前的設定：",
+		fmt.Sprintf("必備條件: %s", filter),
+		fmt.Sprintf("排序: %s", profile),
+		fmt.Sprintf("每次顯示: %d 家", p.pageSize()),
+		fmt.Sprintf("家: %s", places["home"]),
+		fmt.Sprintf("公司: %s", places["work"]),
+	}, "\n")
+}
+
+func settingsReply(title, payload string) map[string]string {
+	return map[string]string{"content_type": "text", "title": title, "payload": payload}
+}
+
+// askSettings shows the preferences of a user and what can be changed.
+func askSettings(a ambassador.Ambassador, user *User, text string) error {
+	if text != "" {
+		text += "\n\n"
+	}
+	replies := []map[string]string{
+		settingsReply("必備條件", "SETTINGS_FILTER"),
+		settingsReply("排序方式", "SETTINGS_PROFILE"),
+		settingsReply("顯示幾家", "SETTINGS_PAGE_SIZE"),
+		settingsReply("家的位置", "SETTINGS_PLACE:home"),
+		settingsReply("公司位置", "SETTINGS_PLACE:work"),
+		settingsReply("全部清除", "SETTINGS_RESET"),
+		settingsReply("完成", "CANCEL"),
+	}
+	return a.AskQuestion(user.Id, text+preferencesText(user.Preferences), replies)
+}
+
+// askSettingsFilter lists the attributes to toggle, checking those chosen.
+func askSettingsFilter(a ambassador.Ambassador, user *User) error {
+	replies := []map[string]string{}
+	for _, attr := range cafeAttributes {
+		title := attr.Title
+		if user.Preferences.Filter.has(attr.Key) {
+			title = "✓ " + title
+		}
+		replies = append(replies, settingsReply(title, "SETTINGS_FILTER:"+attr.Key))
+	}
+	replies = append(replies, settingsReply("好了", "SETTINGS"))
+	return a.AskQuestion(user.Id, "每次搜尋都要符合哪些條件？再按一次可以取消", replies)
+}
+
+func askSettingsProfile(a ambassador.Ambassador, user *User) error {
+	replies := []map[string]string{settingsReply("距離", "SETTINGS_PROFILE:")}
+	for _, p := range scoringProfiles {
+		replies = append(replies, settingsReply(p.Title, "SETTINGS_PROFILE:"+p.Name))
+	}
+	return a.AskQuestion(user.Id, "咖啡店要怎麼排序？", replies)
+}
+
+func askSettingsPageSize(a ambassador.Ambassador, user *User) error {
+	replies := []map[string]string{}
+	for _, n := range []int{3, 5, PAGE_SIZE} {
+		replies = append(replies, settingsReply(fmt.Sprintf("%d 家", n), fmt.Sprintf("SETTINGS_PAGE_SIZE:%d", n)))
+	}
+	return a.AskQuestion(user.Id, "每次要顯示幾家咖啡店？", replies)
+}
+
+// askSettingsPlace asks for the location of a saved place.
+func askSettingsPlace(a ambassador.Ambassador, user *User, kind string) error {
+	replies := []map[string]string{
+		map[string]string{"content_type": "location"},
+		settingsReply("取消", "SETTINGS"),
+	}
+	if *user.Preferences.place(kind) != nil {
+		replies = append(replies, settingsReply("刪除", "SETTINGS_PLACE:"+kind+":delete"))
+	}
+	return a.AskQuestion(user.Id, fmt.Sprintf("%s在哪裡呢？請傳送位置或輸入地址", savedPlaceTitles[kind]), replies)
+}
+
+// settingsPlacePayload encodes the choice of a place as "SETTINGS_PLACE:kind:lat,lng:name".
+func settingsPlacePayload(kind string, p savedPlace) string {
+	return fmt.Sprintf("SETTINGS_PLACE:%s:%f,%f:%s", kind, p.Latitude, p.Longitude, url.QueryEscape(p.Name))
+}
+
+// settingPlaceStates are the states asking for a saved place, and the events
+// leading to them.
+var settingPlaceStates = map[string]struct{ State, Event string }{
+	"home": {"SETTING_HOME", "askHome"},
+	"work": {"SETTING_WORK", "askWork"},
+}
+
+// enterSettingPlace moves the user to the state asking for a saved place.
+// A settings quick reply may be tapped late, e.g. in STANDBY, where the
+// place can not be asked for directly, so the settings are opened first.
+func enterSettingPlace(user *User, kind string) error {
+	s := settingPlaceStates[kind]
+	if user.FSM.Current() == s.State {
+		return nil
+	}
+	if !user.FSM.Can(s.Event) {
+		if err := user.FSM.Event("openSettings"); err != nil {
+			if _, ok := err.(fsm.NoTransitionError); !ok {
+				return err
+			}
+		}
+	}
+	return user.FSM.Event(s.Event)
+}
+
+// savePlace stores a saved place chosen by the user and goes back to the
+// settings.
+func savePlace(a ambassador.Ambassador, user *User, kind string, p savedPlace) error {
+	*user.Preferences.place(kind) = &p
+	user.FSM.Event("openSettings")
+	return askSettings(a, user, fmt.Sprintf("已將%s設在「%s」", savedPlaceTitles[kind], p.Name))
+}
+
+// settingsCommand handles the SETTINGS postbacks. It reports false for
+// other postbacks.
+func settingsCommand(ctx context.Context, user *User, payload string, a ambassador.Ambassador) (handled bool, err error) {
+	items := strings.Split(payload, ":")
+	arg := ""
+	if len(items) > 1 {
+		arg = items[1]
+	}
+
+	switch items[0] {
+	case "SETTINGS":
+		user.FSM.Event("openSettings")
+		err = askSettings(a, user, "")
+	case "SETTINGS_FILTER":
+		user.FSM.Event("openSettings")
+		if arg != "" && findCafeAttribute(arg) != nil {
+			user.Preferences.Filter = user.Preferences.Filter.toggle(arg)
+		}
+		err = askSettingsFilter(a, user)
+	case "SETTINGS_PROFILE":
+		user.FSM.Event("openSettings")
+		if len(items) == 1 {
+			err = askSettingsProfile(a, user)
+		} else {
+			user.Preferences.Profile = ""
+			if p := findScoringProfile(arg); p != nil {
+				user.Preferences.Profile = p.Name
+			}
+			err = askSettings(a, user, "排序方式已更新")
+		}
+	case "SETTINGS_PAGE_SIZE":
+		user.FSM.Event("openSettings")
+		if n, perr := strconv.Atoi(arg); perr == nil && n > 0 && n <= PAGE_SIZE {
+			user.Preferences.PageSize = n
+			err = askSettings(a, user, "顯示數量已更新")
+		} else {
+			err = askSettingsPageSize(a, user)
+		}
+	case "SETTINGS_PLACE":
+		kind := "home"
+		if arg == "work" {
+			kind = "work"
+		}
+		switch {
+		case len(items) == 3 && items[2] == "delete":
+			*user.Preferences.place(kind) = nil
+			user.FSM.Event("openSettings")
+			err = askSettings(a, user, fmt.Sprintf("已刪除%s的位置", savedPlaceTitles[kind]))
+		case len(items) == 4:
+			q, perr := parseCafeQuery(items[2:3])
+			name, _ := url.QueryUnescape(items[3])
+			if perr != nil {
+				return true, perr
+			}
+			err = savePlace(a, user, kind, savedPlace{name, q.Latitude, q.Longitude})
+		default:
+			if perr := enterSettingPlace(user, kind); perr != nil {
+				log.Errorf(ctx, "can not ask %s for the %s place in %s: %s", user.Id, kind, user.State, perr)
+				return true, a.SendText(user.Id, "現在無法設定位置，請說「設定」再試一次")
+			}
+			err = askSettingsPlace(a, user, kind)
+		}
+	case "SETTINGS_RESET":
+		user.FSM.Event("openSettings")
+		user.Preferences = Preferences{}
+		err = askSettings(a, user, "設定已清除")
+	default:
+		return false, nil
+	}
+	return true, err
+}
+
+// settingsHandler handles messages while the user changes the settings.
+func settingsHandler(ctx context.Context, user *User, msg ambassador.Message, a ambassador.Ambassador) (err error) {
+	switch msgContent := msg.Content.(type) {
+	case *ambassador.TextContent:
+		q := strings.TrimSpace(msgContent.Text)
+		switch q {
+		case "完成", "好了", "取消", "結束":
+			user.FSM.Event("cancel")
+			return a.SendText(user.Id, "設定完成，之後的搜尋都會套用。")
+		}
+		err = askSettings(a, user, "請從下方選擇要修改的項目")
+	case *ambassador.CommandContent:
+		var handled bool
+		if handled, err = settingsCommand(ctx, user, msgContent.Payload, a); !handled {
+			// any other postback, e.g. from an earlier carousel, leaves the settings
+			user.FSM.Event("cancel")
+			err = commandHandler(ctx, user, msgContent.Payload, a)
+		}
+	case *ambassador.LocationContent:
+		err = askSettings(a, user, "請先選擇要設定家還是公司的位置")
+	}
+	return
+}
+
+// settingPlaceHandler takes the location of home or work.
+func settingPlaceHandler(ctx context.Context, user *User, msg ambassador.Message, a ambassador.Ambassador) (err error) {
+	kind := "home"
+	if user.State == "SETTING_WORK" {
+		kind = "work"
+	}
+
+	switch msgContent := msg.Content.(type) {
+	case *ambassador.TextContent:
+		if q := strings.TrimSpace(msgContent.Text); q == "取消" || q == "算了" {
+			user.FSM.Event("openSettings")
+			return askSettings(a, user, "")
+		}
+		var places []Place
+		if places, err = resolveGeocoding(ctx, msgContent.Text); err != nil || len(places) == 0 {
+			return a.SendText(user.Id, "無法辨識的地點，請再試一次或傳送位置")
+		}
+		if len(places) == 1 {
+			p := places[0]
+			return savePlace(a, user, kind, savedPlace{p.Name, p.Geometry.Location.Lat, p.Geometry.Location.Lng})
+		}
+		replies := []map[string]string{}
+		for _, p := range places {
+			replies = append(replies, settingsReply(p.Name, settingsPlacePayload(kind,
+				savedPlace{p.Name, p.Geometry.Location.Lat, p.Geometry.Location.Lng})))
+		}
+		replies = append(replies, settingsReply("都不是", "SETTINGS_PLACE:"+kind))
+		err = a.AskQuestion(user.Id, "是哪一個呢？", replies)
+	case *ambassador.CommandContent:
+		var handled bool
+		if handled, err = settingsCommand(ctx, user, msgContent.Payload, a); !handled {
+			user.FSM.Event("cancel")
+			err = commandHandler(ctx, user, msgContent.Payload, a)
+		}
+	case *ambassador.LocationContent:
+		err = savePlace(a, user, kind, savedPlace{"傳送的位置", msgContent.Lat, msgContent.Lon})
+	}
+	return
+}
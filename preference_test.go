@@ -0,0 +1,122 @@
+package cafehunter
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/lemonlatte/ambassador"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/aetest"
+)
+
+func tap(payload string) ambassador.Message {
+	return ambassador.Message{SenderId: "u", Content: &ambassador.CommandContent{Payload: payload}}
+}
+
+func say(text string) ambassador.Message {
+	return ambassador.Message{SenderId: "u", Content: &ambassador.TextContent{Text: text}}
+}
+
+func sendLocation(lat, lng float64) ambassador.Message {
+	return ambassador.Message{SenderId: "u", Content: &ambassador.LocationContent{Lat: lat, Lon: lng}}
+}
+
+func TestSettings(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	store, restore := useMemorySessions()
+	defer restore()
+	cfg := testConfig()
+	a := newFakeAmbassador()
+	session := func() *User {
+		user, err := store.Get(context.Background(), "u")
+		if err != nil || user == nil {
+			t.Fatalf("no session saved: %v", err)
+		}
+		return user
+	}
+
+	for _, step := range []struct {
+		msg   ambassador.Message
+		state string
+	}{
+		{tap("SETTINGS"), "SETTINGS"},
+		{tap("SETTINGS_FILTER:wifi"), "SETTINGS"},
+		{tap("SETTINGS_PROFILE:work"), "SETTINGS"},
+		{tap("SETTINGS_PAGE_SIZE:3"), "SETTINGS"},
+		{say("完成"), "STANDBY"},
+	} {
+		handleMessage(ctx, cfg, step.msg, a)
+		if user := session(); user.State != step.state {
+			t.Fatalf("got state %s, want %s", user.State, step.state)
+		}
+	}
+	p := session().Preferences
+	if !p.Filter.has("wifi") || p.Profile != "work" || p.PageSize != 3 {
+		t.Errorf("got preferences %+v", p)
+	}
+
+	// a settings quick reply tapped after leaving the settings still asks
+	// for the place, and saves the answer
+	handleMessage(ctx, cfg, tap("SETTINGS_PLACE:home"), a)
+	if user := session(); user.State != "SETTING_HOME" {
+		t.Fatalf("got state %s, want SETTING_HOME", user.State)
+	}
+	handleMessage(ctx, cfg, sendLocation(25.0330, 121.5654), a)
+	user := session()
+	if user.State != "SETTINGS" || user.Preferences.Home == nil || user.Preferences.Home.Latitude != 25.0330 {
+		t.Fatalf("home not saved: %s with %+v", user.State, user.Preferences.Home)
+	}
+
+	// asking for work while asked for home switches to work
+	handleMessage(ctx, cfg, tap("SETTINGS_PLACE:home"), a)
+	handleMessage(ctx, cfg, tap("SETTINGS_PLACE:work"), a)
+	if user := session(); user.State != "SETTING_WORK" {
+		t.Fatalf("got state %s, want SETTING_WORK", user.State)
+	}
+	handleMessage(ctx, cfg, say("取消"), a)
+	handleMessage(ctx, cfg, tap("SETTINGS_PLACE:home:delete"), a)
+	if user := session(); user.State != "SETTINGS" || user.Preferences.Home != nil {
+		t.Errorf("home not deleted: %s with %+v", user.State, user.Preferences.Home)
+	}
+	handleMessage(ctx, cfg, say("完成"), a)
+
+	// a location sent in STANDBY is searched with the preferences
+	handleMessage(ctx, cfg, sendLocation(25.0421, 121.5081), a)
+	replies := a.lastReplies("u")
+	if len(replies) == 0 {
+		t.Fatal("no search offered for the location")
+	}
+	q, err := parseCafeQuery(strings.Split(replies[0]["payload"], ":")[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.PageSize != 3 || q.Profile != "work" || !q.Filter.has("wifi") {
+		t.Errorf("got query %+v without the preferences", q)
+	}
+}
+
+func TestSettingsPlaceOutsideSettings(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	a := newFakeAmbassador()
+	// submitting a cafe can not be left for the settings
+	user := newUser("u")
+	user.State = "SUBMIT_NAME"
+	user.attachFSM()
+	if _, err := settingsCommand(ctx, user, "SETTINGS_PLACE:work", a); err != nil {
+		t.Fatal(err)
+	}
+	texts := a.texts("u")
+	if user.State != "SUBMIT_NAME" || len(texts) != 1 || !strings.Contains(texts[0], "無法設定位置") {
+		t.Errorf("got %s with %q", user.State, texts)
+	}
+}
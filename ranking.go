@@ -0,0 +1,90 @@
+package cafehunter
+
+import (
+	"sort"
+	"strings"
+)
+
+// cafeWeights tells how much each rating of a cafe counts in a score.
+type cafeWeights struct {
+	Wifi  float64
+	Seat  float64
+	Quiet float64
+	Tasty float64
+	Price float64
+	Music float64
+	Plug  float64
+}
+
+// scoringProfile ranks cafes for a purpose such as working or dating.
+type scoringProfile struct {
+	Name     string
+	Title    string
+	Keywords []string
+	Weights  cafeWeights
+}
+
+var scoringProfiles = []scoringProfile{
+	{"work", "適合工作", []string{"工作", "讀書", "念書", "唸書", "辦公"}, cafeWeights{Wifi: 3, Seat: 2, Quiet: 2, Plug: 3}},
+	{"date", "適合約會", []string{"約會", "聊天"}, cafeWeights{Tasty: 3, Music: 2}},
+	{"quiet", "安靜優先", []string{"專心", "看書"}, cafeWeights{Quiet: 3, Seat: 1}},
+	{"budget", "省錢", []string{"省錢", "小資", "預算"}, cafeWeights{Price: 1}},
+}
+
+func findScoringProfile(name string) *scoringProfile {
+	for i := range scoringProfiles {
+		if scoringProfiles[i].Name == name {
+			return &scoringProfiles[i]
+		}
+	}
+	return nil
+}
+
+// profileFromText returns the name of the first profile whose keywords
+// appear in a user message, or "" when there is none.
+func profileFromText(text string) string {
+	for _, p := range scoringProfiles {
+		for _, k := range p.Keywords {
+			if strings.Contains(text, k) {
+				return p.Name
+			}
+		}
+	}
+	return ""
+}
+
+// plugRating turns the yes/maybe/no answer about plugs into a rating.
+func plugRating(plug string) float64 {
+	switch plug {
+	case "yes":
+		return 5
+	case "maybe":
+		return 2.5
+	}
+	return 0
+}
+
+// scoreCafe returns the weighted average of the ratings of a cafe, from 0
+// to 5.
+func scoreCafe(c Cafe, p scoringProfile) float64 {
+	w := p.Weights
+	total := w.Wifi + w.Seat + w.Quiet + w.Tasty + w.Price + w.Music + w.Plug
+	if total == 0 {
+		return 0
+	}
+
+	sum := w.Wifi*c.Wifi + w.Seat*c.Seat + w.Quiet*c.Quiet +
+		w.Tasty*c.Tasty + w.Price*c.Price + w.Music*c.Music +
+		w.Plug*plugRating(c.Plug)
+	return sum / total
+}
+
+// rankCafes sorts cafes by their score in a profile, best first. Cafes with
+// the same score keep their order, which is nearest first after a search.
+func rankCafes(cafes []Cafe, p scoringProfile) []Cafe {
+	ranked := append([]Cafe{}, cafes...)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return scoreCafe(ranked[i], p) > scoreCafe(ranked[j], p)
+	})
+	return ranked
+}
@@ -0,0 +1,88 @@
+package cafehunter
+
+import (
+	"reflect"
+	"testing"
+)
+
+// rankingFixtures are nearest first, as a search returns them.
+var rankingFixtures = []Cafe{
+	{Id: "desk", Distance: 100, Wifi: 5, Seat: 4, Quiet: 4, Tasty: 2, Price: 3, Music: 2, Plug: "yes"},
+	{Id: "date", Distance: 200, Wifi: 2, Seat: 3, Quiet: 2, Tasty: 5, Price: 2, Music: 5, Plug: "no"},
+	{Id: "cheap", Distance: 300, Wifi: 3, Seat: 3, Quiet: 3, Tasty: 3, Price: 5, Music: 3, Plug: "maybe"},
+}
+
+func cafeIds(cafes []Cafe) []string {
+	ids := []string{}
+	for _, c := range cafes {
+		ids = append(ids, c.Id)
+	}
+	return ids
+}
+
+func TestScoreCafe(t *testing.T) {
+	for _, c := range []struct {
+		profile string
+		cafe    int
+		score   float64
+	}{
+		// (3*5 + 2*4 + 2*4 + 3*5) / 10
+		{"work", 0, 4.6},
+		// (3*3 + 2*3 + 2*3 + 3*2.5) / 10
+		{"work", 2, 2.85},
+		// (3*5 + 2*5) / 5
+		{"date", 1, 5},
+		{"budget", 2, 5},
+	} {
+		if got := scoreCafe(rankingFixtures[c.cafe], *findScoringProfile(c.profile)); got != c.score {
+			t.Errorf("%s score of %s: got %v, want %v", c.profile, rankingFixtures[c.cafe].Id, got, c.score)
+		}
+	}
+}
+
+func TestRankCafes(t *testing.T) {
+	for _, c := range []struct {
+		profile string
+		want    []string
+	}{
+		{"work", []string{"desk", "cheap", "date"}},
+		{"date", []string{"date", "cheap", "desk"}},
+		{"budget", []string{"cheap", "desk", "date"}},
+	} {
+		got := cafeIds(rankCafes(rankingFixtures, *findScoringProfile(c.profile)))
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %v, want %v", c.profile, got, c.want)
+		}
+	}
+	if got := cafeIds(rankingFixtures); !reflect.DeepEqual(got, []string{"desk", "date", "cheap"}) {
+		t.Errorf("ranking changed the order of the search results to %v", got)
+	}
+}
+
+func TestRankCafesKeepsDistanceOrderOnTies(t *testing.T) {
+	cafes := []Cafe{
+		{Id: "near", Distance: 50, Price: 4},
+		{Id: "cheaper", Distance: 120, Price: 5},
+		{Id: "middle", Distance: 180, Price: 4},
+		{Id: "dear", Distance: 250, Price: 1},
+		{Id: "far", Distance: 400, Price: 4},
+	}
+	want := []string{"cheaper", "near", "middle", "far", "dear"}
+	if got := cafeIds(rankCafes(cafes, *findScoringProfile("budget"))); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestProfileFromText(t *testing.T) {
+	for text, want := range map[string]string{
+		"中山站附近適合工作的咖啡店": "work",
+		"想找約會的地方":       "date",
+		"小資族的咖啡店":       "budget",
+		"安靜可以看書的":       "quiet",
+		"中山站":           "",
+	} {
+		if got := profileFromText(text); got != want {
+			t.Errorf("profileFromText(%q) = %q, want %q", text, got, want)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package cafehunter
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lemonlatte/ambassador"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/log"
+)
+
+// userRating is how a user rated a cafe, from 1 to 5 for each aspect or 0
+// for an aspect skipped.
+type userRating struct {
+	CafeId   string    `json:"cafeId"`
+	SenderId string    `json:"senderId"`
+	Wifi     float64   `json:"wifi"`
+	Quiet    float64   `json:"quiet"`
+	Tasty    float64   `json:"tasty"`
+	Price    float64   `json:"cheap"`
+	Time     time.Time `json:"time"`
+}
+
+// ratingSummary is the average of the ratings users gave a cafe, each
+// aspect over the users who rated it, and how many users rated the cafe.
+type ratingSummary struct {
+	Count int     `json:"count"`
+	Wifi  float64 `json:"wifi"`
+	Quiet float64 `json:"quiet"`
+	Tasty float64 `json:"tasty"`
+	Price float64 `json:"cheap"`
+}
+
+func summarizeRatings(ratings []userRating) ratingSummary {
+	s := ratingSummary{Count: len(ratings)}
+	average := func(get func(r userRating) float64) float64 {
+		sum, n := 0.0, 0
+		for _, r := range ratings {
+			if v := get(r); v > 0 {
+				sum += v
+				n++
+			}
+		}
+		if n == 0 {
+			return 0
+		}
+		return sum / float64(n)
+	}
+	s.Wifi = average(func(r userRating) float64 { return r.Wifi })
+	s.Quiet = average(func(r userRating) float64 { return r.Quiet })
+	s.Tasty = average(func(r userRating) float64 { return r.Tasty })
+	s.Price = average(func(r userRating) float64 { return r.Price })
+	return s
+}
+
+// Overall is the average of the aspects users rated, 0 when none.
+func (s ratingSummary) Overall() float64 {
+	sum, n := 0.0, 0
+	for _, v := range []float64{s.Wifi, s.Quiet, s.Tasty, s.Price} {
+		if v > 0 {
+			sum += v
+			n++
+		}
+	}
+	if n == 0 {
+		return 0
+	}
+	return sum / float64(n)
+}
+
+// RatingStore keeps the ratings users give cafes, one per user and cafe.
+// Put replaces the earlier rating of the same user for the same cafe.
+// Summaries returns the summaries of the cafes of ids rated so far by cafe id.
+type RatingStore interface {
+	Put(ctx context.Context, r userRating) error
+	Summaries(ctx context.Context, ids []string) (map[string]ratingSummary, error)
+}
+
+var ratings RatingStore
+
+// newRatingStore keeps ratings in the same kind of store as sessions.
+func newRatingStore(cfg *Config) RatingStore {
+	if cfg.SessionStore == "memory" {
+		return newMemoryRatingStore()
+	}
+	return &firebaseRatingStore{}
+}
+
+// memoryRatingStore keeps ratings in the memory of a single instance.
+type memoryRatingStore struct {
+	mu    sync.Mutex
+	cafes map[string]map[string]userRating
+}
+
+func newMemoryRatingStore() *memoryRatingStore {
+	return &memoryRatingStore{cafes: map[string]map[string]userRating{}}
+}
+
+func (s *memoryRatingStore) Put(ctx context.Context, r userRating) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cafes[r.CafeId] == nil {
+		s.cafes[r.CafeId] = map[string]userRating{}
+	}
+	s.cafes[r.CafeId][r.SenderId] = r
+	return nil
+}
+
+func (s *memoryRatingStore) Summaries(ctx context.Context, ids []string) (map[string]ratingSummary, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	summaries := map[string]ratingSummary{}
+	for _, id := range ids {
+		users, ok := s.cafes[id]
+		if !ok {
+			continue
+		}
+		list := []userRating{}
+		for _, r := range users {
+			list = append(list, r)
+		}
+		summaries[id] = summarizeRatings(list)
+	}
+	return summaries, nil
+}
+
+// firebaseRatingStore keeps ratings under "ratings/<cafe id>/<sender id>".
+// A rating is a single write of its own node, so users rating the same cafe
+// at the same time never overwrite each other, and the summaries are made
+// when read from the ratings of the cafes shown.
+type firebaseRatingStore struct{}
+
+func (s *firebaseRatingStore) Put(ctx context.Context, r userRating) error {
+	return newFirebaseClient(ctx).Child("ratings").Child(r.CafeId).Child(r.SenderId).Set(r)
+}
+
+func (s *firebaseRatingStore) Summaries(ctx context.Context, ids []string) (map[string]ratingSummary, error) {
+	firegoClient := newFirebaseClient(ctx)
+
+	summaries := map[string]ratingSummary{}
+	for _, id := range ids {
+		v := map[string]userRating{}
+		if err := firegoClient.Child("ratings").Child(id).Value(&v); err != nil {
+			return nil, fmt.Errorf("can not fetch ratings of %s: %s", id, err)
+		}
+		if len(v) == 0 {
+			continue
+		}
+		list := make([]userRating, 0, len(v))
+		for _, rating := range v {
+			list = append(list, rating)
+		}
+		summaries[id] = summarizeRatings(list)
+	}
+	return summaries, nil
+}
+
+// withReviews fills in the ratings users gave the cafes shown on the page
+// of size starting at offset, leaving the other cafes as they are. The cafes
+// are shown with their imported ratings only when the ratings can not be
+// read.
+func withReviews(ctx context.Context, cafes []Cafe, offset, size int) []Cafe {
+	reviewed := append([]Cafe{}, cafes...)
+	if offset >= len(cafes) {
+		return reviewed
+	}
+	end := offset + size
+	if end > len(cafes) {
+		end = len(cafes)
+	}
+
+	ids := []string{}
+	for _, c := range cafes[offset:end] {
+		ids = append(ids, c.Id)
+	}
+	summaries, err := ratings.Summaries(ctx, ids)
+	if err != nil {
+		log.Errorf(ctx, "can not get rating summaries: %s", err)
+		return reviewed
+	}
+
+	for i := offset; i < end; i++ {
+		reviewed[i].Reviews = summaries[reviewed[i].Id]
+	}
+	return reviewed
+}
+
+// reviewsText describes the ratings users gave a cafe, e.g. "網友評分: 4.3 (3 人)".
+func reviewsText(s ratingSummary) string {
+	if s.Count == 0 {
+		return "網友評分: 尚無"
+	}
+	return fmt.Sprintf("網友評分: %.1f (%d 人)", s.Overall(), s.Count)
+}
+
+// ratingAspect is an aspect of a cafe users rate, in the order asked.
+type ratingAspect struct {
+	Key   string
+	Title string
+	Set   func(r *userRating, v float64)
+}
+
+var ratingAspects = []ratingAspect{
+	{"wifi", "Wifi 穩定", func(r *userRating, v float64) { r.Wifi = v }},
+	{"quiet", "安靜", func(r *userRating, v float64) { r.Quiet = v }},
+	{"tasty", "咖啡好喝", func(r *userRating, v float64) { r.Tasty = v }},
+	{"cheap", "價格便宜", func(r *userRating, v float64) { r.Price = v }},
+}
+
+// ratePayload encodes a rating in progress as "RATE:cafeId[:answers]", the
+// answers given so far being written like url query values.
+func ratePayload(id string, answers url.Values) string {
+	if len(answers) == 0 {
+		return "RATE:" + id
+	}
+	return "RATE:" + id + ":" + answers.Encode()
+}
+
+// rateCafe answers RATE by asking about the next aspect not rated yet, and
+// stores the rating once every aspect is answered.
+func rateCafe(ctx context.Context, a ambassador.Ambassador, user *User, args []string) error {
+	cafe, err := findCafe(ctx, a, user.Id, args[0])
+	if cafe == nil {
+		return err
+	}
+	user.LastCafe = cafe.Id
+
+	answers := url.Values{}
+	if len(args) > 1 {
+		if answers, err = url.ParseQuery(args[1]); err != nil {
+			return err
+		}
+	}
+
+	r := userRating{CafeId: cafe.Id, SenderId: user.Id, Time: time.Now()}
+	rated := 0
+	for _, aspect := range ratingAspects {
+		if _, ok := answers[aspect.Key]; !ok {
+			return askRating(a, user, cafe, aspect, answers)
+		}
+		v, _ := strconv.Atoi(answers.Get(aspect.Key))
+		if v < 1 || v > 5 {
+			continue
+		}
+		aspect.Set(&r, float64(v))
+		rated++
+	}
+	if rated == 0 {
+		return a.SendText(user.Id, "你沒有評任何一項，這次就不記錄囉。")
+	}
+
+	if err := ratings.Put(ctx, r); err != nil {
+		log.Errorf(ctx, "can not save rating of %s for %s: %s", user.Id, cafe.Id, err)
+		return a.SendText(user.Id, "儲存評分時發生錯誤，請稍後再試")
+	}
+	return a.SendText(user.Id, fmt.Sprintf("謝謝你為「%s」評分！", cafe.Name))
+}
+
+// askRating asks for the stars of an aspect, or to skip it.
+func askRating(a ambassador.Ambassador, user *User, cafe *Cafe, aspect ratingAspect, answers url.Values) error {
+	answer := func(title string, v int) map[string]string {
+		next := url.Values{}
+		for k, vs := range answers {
+			next[k] = vs
+		}
+		next.Set(aspect.Key, strconv.Itoa(v))
+		return map[string]string{
+			"content_type": "text",
+			"title":        title,
+			"payload":      ratePayload(cafe.Id, next),
+		}
+	}
+
+	replies := []map[string]string{}
+	for v := 1; v <= 5; v++ {
+		replies = append(replies, answer(strings.Repeat("🌟", v), v))
+	}
+	replies = append(replies, answer("跳過", 0), map[string]string{
+		"content_type": "text",
+		"title":        "取消",
+		"payload":      "CANCEL",
+	})
+	return a.AskQuestion(user.Id, fmt.Sprintf("「%s」的%s給幾顆星？", cafe.Name, aspect.Title), replies)
+}
@@ -0,0 +1,84 @@
+package cafehunter
+
+import (
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/aetest"
+)
+
+// askedRatingStore tells which cafes the summaries were asked for.
+type askedRatingStore struct {
+	*memoryRatingStore
+	asked [][]string
+}
+
+func (s *askedRatingStore) Summaries(ctx context.Context, ids []string) (map[string]ratingSummary, error) {
+	s.asked = append(s.asked, ids)
+	return s.memoryRatingStore.Summaries(ctx, ids)
+}
+
+func TestMemoryRatingStore(t *testing.T) {
+	ctx := context.Background()
+	s := newMemoryRatingStore()
+	for _, r := range []userRating{
+		{CafeId: "a", SenderId: "u1", Wifi: 1, Quiet: 2},
+		{CafeId: "a", SenderId: "u1", Wifi: 5, Quiet: 4},
+		{CafeId: "a", SenderId: "u2", Wifi: 3, Tasty: 4},
+		{CafeId: "b", SenderId: "u1", Price: 2},
+	} {
+		if err := s.Put(ctx, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	summaries, err := s.Summaries(ctx, []string{"a", "unrated"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]ratingSummary{
+		// the second rating of u1 replaces the first
+		"a": {Count: 2, Wifi: 4, Quiet: 4, Tasty: 4},
+	}
+	if !reflect.DeepEqual(summaries, want) {
+		t.Errorf("got %+v, want %+v", summaries, want)
+	}
+}
+
+func TestWithReviewsFillsThePageOnly(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	store := &askedRatingStore{memoryRatingStore: newMemoryRatingStore()}
+	saved := ratings
+	ratings = store
+	defer func() { ratings = saved }()
+
+	for _, id := range []string{"a", "b", "c", "d"} {
+		store.Put(ctx, userRating{CafeId: id, SenderId: "u1", Wifi: 4})
+	}
+	cafes := []Cafe{{Id: "a"}, {Id: "b"}, {Id: "c"}, {Id: "d"}}
+
+	reviewed := withReviews(ctx, cafes, 1, 2)
+	if want := [][]string{{"b", "c"}}; !reflect.DeepEqual(store.asked, want) {
+		t.Errorf("asked the summaries of %v, want %v", store.asked, want)
+	}
+	for i, c := range reviewed {
+		if shown := i == 1 || i == 2; (c.Reviews.Count > 0) != shown {
+			t.Errorf("%s: got reviews %+v", c.Id, c.Reviews)
+		}
+	}
+	if cafes[1].Reviews.Count != 0 {
+		t.Error("the reviews were filled in the cafes given")
+	}
+
+	// a page past the end asks for nothing
+	store.asked = nil
+	if reviewed := withReviews(ctx, cafes, 4, 2); len(reviewed) != 4 || store.asked != nil {
+		t.Errorf("got %d cafes, asked %v", len(reviewed), store.asked)
+	}
+}
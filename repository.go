@@ -0,0 +1,263 @@
+package cafehunter
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/context"
+
+	"github.com/TomiHiltunen/geohash-golang"
+)
+
+// CafeRepository looks up and stores cafes. Nearby returns the cafes within
+// radius meters of a point, nearest first, with Cafe.Distance filled in.
+// InCells returns the cafes whose geohash starts with any of the given
+// cells. ByID returns a nil cafe without error when no cafe has the given
+// id. Update stores cafes by id and removes the cafes of the given ids.
+type CafeRepository interface {
+	Nearby(ctx context.Context, lat, lng, radius float64) ([]Cafe, error)
+	InCells(ctx context.Context, cells []string) ([]Cafe, error)
+	ByID(ctx context.Context, id string) (*Cafe, error)
+	ByCity(ctx context.Context, city string) ([]Cafe, error)
+	All(ctx context.Context) ([]Cafe, error)
+	Update(ctx context.Context, put []Cafe, remove []string) error
+}
+
+// newCafeRepository returns an in-memory repository when cfg.CafeDataFile is
+// set and the Firebase repository otherwise.
+func newCafeRepository(cfg *Config) (CafeRepository, error) {
+	if cfg.CafeDataFile == "" {
+		return &firebaseCafeRepository{}, nil
+	}
+
+	f, err := os.Open(cfg.CafeDataFile)
+	if err != nil {
+		return nil, fmt.Errorf("can not open cafe data file: %s", err)
+	}
+	defer f.Close()
+
+	cafes, _, err := decodeNomadCafes(f)
+	if err != nil {
+		return nil, fmt.Errorf("can not decode cafe data file %s: %s", cfg.CafeDataFile, err)
+	}
+	return newMemoryCafeRepository(cafes), nil
+}
+
+// geohashPrecision returns the finest geohash precision whose cells are
+// still at least radius meters tall and wide, so that a cell and its eight
+// neighbours cover every point within radius.
+func geohashPrecision(radius float64) int {
+	// approximate cell height and width in meters of precision 1 to 8
+	cellSizes := [][2]float64{
+		{5000000, 5000000},
+		{625000, 1250000},
+		{156000, 156000},
+		{19500, 39100},
+		{4890, 4890},
+		{610, 1220},
+		{153, 153},
+		{19.1, 38.2},
+	}
+
+	precision := 1
+	for i, size := range cellSizes {
+		if size[0] < radius || size[1] < radius {
+			break
+		}
+		precision = i + 1
+	}
+	return precision
+}
+
+// firebaseCafeRepository queries the "cafes" path of Firebase, which is
+// indexed by the geohash of every cafe and keyed by cafe id.
+type firebaseCafeRepository struct{}
+
+// CAFE_UPDATE_BATCH is how many cafes are written to Firebase per request.
+const CAFE_UPDATE_BATCH = 500
+
+// nearbyCells returns the geohash cell of a point and the cells around it,
+// which together cover every point within radius meters.
+func nearbyCells(lat, lng, radius float64) []string {
+	h := geohash.EncodeWithPrecision(lat, lng, geohashPrecision(radius))
+	return append(geohash.CalculateAllAdjacent(h), h)
+}
+
+func (r *firebaseCafeRepository) Nearby(ctx context.Context, lat, lng, radius float64) ([]Cafe, error) {
+	cafes, err := r.InCells(ctx, nearbyCells(lat, lng, radius))
+	if err != nil {
+		return nil, err
+	}
+	return rankByDistance(cafes, lat, lng, radius), nil
+}
+
+func (r *firebaseCafeRepository) InCells(ctx context.Context, cells []string) ([]Cafe, error) {
+	firegoClient := newFirebaseClient(ctx)
+
+	cafes := []Cafe{}
+	for _, a := range cells {
+		v := map[string]Cafe{}
+		err := firegoClient.Child("cafes").OrderBy("geohash").StartAt(a).EndAt(a + "~").Value(&v)
+		if err != nil {
+			return nil, fmt.Errorf("can not fetch cafes in %s: %s", a, err)
+		}
+		for _, cafe := range v {
+			cafes = append(cafes, cafe)
+		}
+	}
+	return cafes, nil
+}
+
+// ByID reads the cafe directly at its key, cafes being stored by id.
+func (r *firebaseCafeRepository) ByID(ctx context.Context, id string) (*Cafe, error) {
+	var cafe *Cafe
+	if err := newFirebaseClient(ctx).Child("cafes").Child(id).Value(&cafe); err != nil {
+		return nil, err
+	}
+	return cafe, nil
+}
+
+func (r *firebaseCafeRepository) ByCity(ctx context.Context, city string) ([]Cafe, error) {
+	v := map[string]Cafe{}
+	if err := newFirebaseClient(ctx).Child("cafes").OrderBy("city").EqualTo(city).Value(&v); err != nil {
+		return nil, err
+	}
+
+	cafes := make([]Cafe, 0, len(v))
+	for _, cafe := range v {
+		cafes = append(cafes, cafe)
+	}
+	return cafes, nil
+}
+
+func (r *firebaseCafeRepository) All(ctx context.Context) ([]Cafe, error) {
+	v := map[string]Cafe{}
+	if err := newFirebaseClient(ctx).Child("cafes").Value(&v); err != nil {
+		return nil, err
+	}
+
+	cafes := make([]Cafe, 0, len(v))
+	for _, cafe := range v {
+		cafes = append(cafes, cafe)
+	}
+	return cafes, nil
+}
+
+// Update writes the changes as multi-path updates, in which a nil value
+// removes a cafe.
+func (r *firebaseCafeRepository) Update(ctx context.Context, put []Cafe, remove []string) error {
+	changes := map[string]interface{}{}
+	for _, cafe := range put {
+		changes[cafe.Id] = cafe
+	}
+	for _, id := range remove {
+		changes[id] = nil
+	}
+
+	firegoClient := newFirebaseClient(ctx).Child("cafes")
+	batch := map[string]interface{}{}
+	for id, v := range changes {
+		batch[id] = v
+		if len(batch) == CAFE_UPDATE_BATCH {
+			if err := firegoClient.Update(batch); err != nil {
+				return fmt.Errorf("can not update cafes: %s", err)
+			}
+			batch = map[string]interface{}{}
+		}
+	}
+	if len(batch) > 0 {
+		if err := firegoClient.Update(batch); err != nil {
+			return fmt.Errorf("can not update cafes: %s", err)
+		}
+	}
+	return nil
+}
+
+// memoryCafeRepository serves a list of cafes, e.g. loaded from a cafenomad
+// JSON dump, so the bot can run without Firebase.
+type memoryCafeRepository struct {
+	mu    sync.RWMutex
+	cafes []Cafe
+}
+
+func newMemoryCafeRepository(cafes []Cafe) *memoryCafeRepository {
+	return &memoryCafeRepository{cafes: cafes}
+}
+
+func (r *memoryCafeRepository) Nearby(ctx context.Context, lat, lng, radius float64) ([]Cafe, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return rankByDistance(r.cafes, lat, lng, radius), nil
+}
+
+func (r *memoryCafeRepository) InCells(ctx context.Context, cells []string) ([]Cafe, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	cafes := []Cafe{}
+	for _, cafe := range r.cafes {
+		for _, cell := range cells {
+			if strings.HasPrefix(cafe.Geohash, cell) {
+				cafes = append(cafes, cafe)
+				break
+			}
+		}
+	}
+	return cafes, nil
+}
+
+func (r *memoryCafeRepository) ByID(ctx context.Context, id string) (*Cafe, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, cafe := range r.cafes {
+		if cafe.Id == id {
+			c := cafe
+			return &c, nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *memoryCafeRepository) ByCity(ctx context.Context, city string) ([]Cafe, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	cafes := []Cafe{}
+	for _, cafe := range r.cafes {
+		if strings.EqualFold(cafe.City, city) {
+			cafes = append(cafes, cafe)
+		}
+	}
+	return cafes, nil
+}
+
+func (r *memoryCafeRepository) All(ctx context.Context) ([]Cafe, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]Cafe{}, r.cafes...), nil
+}
+
+func (r *memoryCafeRepository) Update(ctx context.Context, put []Cafe, remove []string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	changed := map[string]bool{}
+	for _, id := range remove {
+		changed[id] = true
+	}
+	for _, cafe := range put {
+		changed[cafe.Id] = true
+	}
+
+	cafes := []Cafe{}
+	for _, cafe := range r.cafes {
+		if !changed[cafe.Id] {
+			cafes = append(cafes, cafe)
+		}
+	}
+	r.cafes = append(cafes, put...)
+	return nil
+}
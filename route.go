@@ -0,0 +1,264 @@
+package cafehunter
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/lemonlatte/ambassador"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/log"
+	"googlemaps.github.io/maps"
+)
+
+const (
+	ROUTE_WIDTH      = 300.0   // meters a cafe may be off the route
+	MAX_ROUTE_LENGTH = 10000.0 // meters between the ends of a route
+	ROUTE_PATH_LIMIT = 800     // characters of the path in a payload, which Messenger keeps to 1000
+)
+
+// routePattern matches questions such as "從台北車站走到西門町路上有什麼咖啡店".
+var routePattern = regexp.MustCompile(`從(.+?)(?:走路|走|騎車|開車)?到(.+?)(?:的)?(?:路上|沿路|沿途|途中|之間)`)
+
+// routeEnds returns the two places a route question goes from and to. When
+// the message does not spell them out, the two locations LUIS found are
+// taken in the order they appear in the message.
+func routeEnds(message string, locations []string) (from, to string, ok bool) {
+	if m := routePattern.FindStringSubmatch(message); m != nil {
+		return m[1], m[2], true
+	}
+	if len(locations) != 2 {
+		return "", "", false
+	}
+	from, to = locations[0], locations[1]
+	if i, j := strings.Index(message, from), strings.Index(message, to); i >= 0 && j >= 0 && j < i {
+		from, to = to, from
+	}
+	return from, to, true
+}
+
+// isRouteQuestion reports whether a message asks for cafes along a route
+// rather than around a place.
+func isRouteQuestion(message string, intent string) bool {
+	return intent == "FindCafeOnRoute" || routePattern.MatchString(message)
+}
+
+// routeQuery is a search for the cafes along the way between two points,
+// carried in postback payloads like cafeQuery.
+type routeQuery struct {
+	From   maps.LatLng
+	To     maps.LatLng
+	Filter CafeFilter
+	Offset int
+
+	// Path is the walking path found for the first page, carried to the
+	// next pages so they show the same cafes without asking Google again.
+	Path []maps.LatLng
+
+	// PageSize is how many cafes are shown at a time, PAGE_SIZE when zero.
+	PageSize int
+}
+
+func (q routeQuery) pageSize() int {
+	return cafeQuery{PageSize: q.PageSize}.pageSize()
+}
+
+// payload encodes the query after command as
+// "COMMAND:fromLat,fromLng,toLat,toLng[:options]".
+func (q routeQuery) payload(command string) string {
+	p := fmt.Sprintf("%s:%f,%f,%f,%f", command, q.From.Lat, q.From.Lng, q.To.Lat, q.To.Lng)
+
+	options := url.Values{}
+	if len(q.Filter) > 0 {
+		options.Set("f", q.Filter.String())
+	}
+	if q.Offset > 0 {
+		options.Set("o", strconv.Itoa(q.Offset))
+	}
+	if q.PageSize > 0 {
+		options.Set("n", strconv.Itoa(q.PageSize))
+	}
+	if len(q.Path) > 0 {
+		options.Set("w", maps.Encode(q.Path))
+	}
+	if len(options) > 0 {
+		p += ":" + options.Encode()
+	}
+	return p
+}
+
+// parseRouteQuery decodes the arguments following the command of a payload
+// written by routeQuery.payload.
+func parseRouteQuery(args []string) (q routeQuery, err error) {
+	if len(args) == 0 {
+		return q, fmt.Errorf("missing coordinates")
+	}
+
+	coords := strings.Split(args[0], ",")
+	if len(coords) != 4 {
+		return q, fmt.Errorf("invalid coordinates: %s", args[0])
+	}
+	values := make([]float64, len(coords))
+	for i, c := range coords {
+		if values[i], err = strconv.ParseFloat(c, 64); err != nil {
+			return
+		}
+	}
+	q.From = maps.LatLng{Lat: values[0], Lng: values[1]}
+	q.To = maps.LatLng{Lat: values[2], Lng: values[3]}
+
+	if len(args) > 1 {
+		var options url.Values
+		if options, err = url.ParseQuery(args[1]); err != nil {
+			return
+		}
+		q.Filter = parseCafeFilter(options.Get("f"))
+		if o := options.Get("o"); o != "" {
+			if q.Offset, err = strconv.Atoi(o); err != nil {
+				return
+			}
+		}
+		if n := options.Get("n"); n != "" {
+			if q.PageSize, err = strconv.Atoi(n); err != nil {
+				return
+			}
+		}
+		if w := options.Get("w"); w != "" {
+			if q.Path, err = maps.DecodePolyline(w); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// walkingPath returns the walking route Google Maps suggests between two
+// points, or the straight line between them without a Maps API key or when
+// Google fails.
+func walkingPath(ctx context.Context, from, to maps.LatLng) []maps.LatLng {
+	straight := []maps.LatLng{from, to}
+	if config.GoogleMapsAPIKey == "" {
+		return straight
+	}
+
+	c, err := newMapsClient(ctx)
+	if err != nil {
+		log.Warningf(ctx, "can not create google map api client: %s", err)
+		return straight
+	}
+	routes, _, err := c.Directions(ctx, &maps.DirectionsRequest{
+		Origin:      from.String(),
+		Destination: to.String(),
+		Mode:        maps.TravelModeWalking,
+	})
+	if err != nil || len(routes) == 0 {
+		log.Warningf(ctx, "can not find walking route: %v", err)
+		return straight
+	}
+
+	path, err := routes[0].OverviewPolyline.Decode()
+	if err != nil || len(path) < 2 {
+		log.Warningf(ctx, "can not decode walking route: %v", err)
+		return straight
+	}
+	return path
+}
+
+// fitPath simplifies a path until it takes at most limit characters in a
+// payload, staying as close to the path as that allows.
+func fitPath(path []maps.LatLng, limit int) []maps.LatLng {
+	for tolerance := 5.0; ; tolerance *= 2 {
+		fitted := simplifyPath(path, tolerance)
+		if len(fitted) <= 2 || len(url.QueryEscape(maps.Encode(fitted))) <= limit {
+			return fitted
+		}
+	}
+}
+
+// findCafeAlongRoute returns the cafes within width meters of a path, in the
+// order they are passed.
+func findCafeAlongRoute(ctx context.Context, path []maps.LatLng, width float64) ([]Cafe, error) {
+	cafes, err := cafeRepo.InCells(ctx, corridorCells(path, width))
+	if err != nil {
+		return nil, err
+	}
+	return rankAlongRoute(cafes, path, width), nil
+}
+
+// replyCafesAlongRoute sends the page of the cafes along a route starting at
+// the query offset, offering the next page when there is one. The walking
+// path is looked up for the first page only and passed on to the next.
+func replyCafesAlongRoute(ctx context.Context, a ambassador.Ambassador, senderId string, q routeQuery) (err error) {
+	if len(q.Path) < 2 {
+		q.Path = fitPath(walkingPath(ctx, q.From, q.To), ROUTE_PATH_LIMIT)
+	}
+	cafes, err := findCafeAlongRoute(ctx, q.Path, ROUTE_WIDTH)
+	if err != nil {
+		log.Errorf(ctx, "can not fetch cafes along route: %s", err)
+		return a.SendText(senderId, "查詢咖啡店時發生錯誤，請稍後再試")
+	}
+	cafes = withReviews(ctx, q.Filter.Apply(cafes), q.Offset, q.pageSize())
+
+	kind := "咖啡店"
+	if len(q.Filter) > 0 {
+		kind = fmt.Sprintf("%s的咖啡店", q.Filter.Description())
+	}
+
+	summary, items, n := cafeToFBTemplate(cafes, q.Offset, q.pageSize(), searchResultButtons)
+	if n == 0 {
+		return a.SendText(senderId, fmt.Sprintf("這條路上沒有我知道的%s。", kind))
+	}
+	if q.Offset >= n {
+		return a.SendText(senderId, "沒有更多咖啡店了。")
+	}
+	if q.Offset == 0 {
+		if err = a.SendText(senderId, fmt.Sprintf("路上找到 %d 家%s，依沿途順序排列", n, kind)); err != nil {
+			return
+		}
+		if err = a.SendTemplate(senderId, summary); err != nil {
+			return
+		}
+	}
+	if err = a.SendTemplate(senderId, items); err != nil {
+		return
+	}
+
+	if next := q.Offset + q.pageSize(); next < n {
+		more := q
+		more.Offset = next
+		err = a.AskQuestion(senderId, "還有更多咖啡店", []map[string]string{
+			map[string]string{
+				"content_type": "text",
+				"title":        "看更多",
+				"payload":      more.payload("FIND_CAFE_ROUTE"),
+			},
+		})
+	}
+	return
+}
+
+// routeSearchHandler resolves both ends of a route and replies with the
+// cafes along the way. The first place found for each end is taken.
+func routeSearchHandler(ctx context.Context, user *User, from, to string, a ambassador.Ambassador) (err error) {
+	user.FSM.Event("responeResult")
+
+	ends := []maps.LatLng{}
+	for _, location := range []string{from, to} {
+		places, err := resolveGeocoding(ctx, location)
+		if err != nil || len(places) == 0 {
+			return a.SendText(user.Id, fmt.Sprintf("很抱歉，無法在我的地圖上找到「%s」", location))
+		}
+		ends = append(ends, places[0].Geometry.Location)
+	}
+
+	if distance(ends[0].Lat, ends[0].Lng, ends[1].Lat, ends[1].Lng) > MAX_ROUTE_LENGTH {
+		return a.SendText(user.Id, fmt.Sprintf("兩地相距超過 %s，請縮短路線", radiusText(MAX_ROUTE_LENGTH)))
+	}
+
+	if err = a.SendText(user.Id, fmt.Sprintf("為您尋找從「%s」到「%s」路上的咖啡店", from, to)); err != nil {
+		return
+	}
+	return replyCafesAlongRoute(ctx, a, user.Id, user.applyRoutePreferences(routeQuery{From: ends[0], To: ends[1], Filter: user.Filter}))
+}
@@ -0,0 +1,163 @@
+package cafehunter
+
+import (
+	"encoding/json"
+	"math"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"google.golang.org/appengine/aetest"
+	"googlemaps.github.io/maps"
+)
+
+// samplePath walks from 西門 past the station to 中山, passing the cafes of
+// the sample fixture in that order.
+var samplePath = []maps.LatLng{
+	{Lat: 25.0425, Lng: 121.5065},
+	{Lat: 25.0440, Lng: 121.5110},
+	{Lat: 25.0462, Lng: 121.5158},
+	{Lat: 25.0500, Lng: 121.5185},
+	{Lat: 25.0532, Lng: 121.5210},
+}
+
+// carouselItems returns the elements of every carousel sent to a user.
+func carouselItems(a *fakeAmbassador, to string) []map[string]interface{} {
+	items := []map[string]interface{}{}
+	for _, text := range a.texts(to) {
+		elements := []map[string]interface{}{}
+		if json.Unmarshal([]byte(text), &elements) != nil {
+			continue
+		}
+		for _, e := range elements {
+			if _, ok := e["subtitle"]; ok {
+				items = append(items, e)
+			}
+		}
+	}
+	return items
+}
+
+func TestSimplifyPath(t *testing.T) {
+	path := []maps.LatLng{
+		{Lat: 25.0400, Lng: 121.5000},
+		{Lat: 25.04001, Lng: 121.5050}, // a meter off the straight line
+		{Lat: 25.0400, Lng: 121.5100},
+		{Lat: 25.0500, Lng: 121.5100}, // a corner
+	}
+	want := []maps.LatLng{path[0], path[2], path[3]}
+	if got := simplifyPath(path, 5); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got := simplifyPath(path, 5000); !reflect.DeepEqual(got, []maps.LatLng{path[0], path[3]}) {
+		t.Errorf("got %v, want the ends only", got)
+	}
+	if path[1].Lng != 121.5050 {
+		t.Error("the path was changed")
+	}
+}
+
+func TestFitPath(t *testing.T) {
+	// a winding path far too long for a payload
+	path := []maps.LatLng{}
+	for i := 0; i < 500; i++ {
+		path = append(path, maps.LatLng{Lat: 25.04 + float64(i)*0.0001, Lng: 121.50 + float64(i%2)*0.001})
+	}
+	fitted := fitPath(path, ROUTE_PATH_LIMIT)
+	if n := len(url.QueryEscape(maps.Encode(fitted))); n > ROUTE_PATH_LIMIT {
+		t.Errorf("got a path of %d characters, want at most %d", n, ROUTE_PATH_LIMIT)
+	}
+	if fitted[0] != path[0] || fitted[len(fitted)-1] != path[len(path)-1] {
+		t.Error("the ends of the path were not kept")
+	}
+	if got := fitPath(samplePath, ROUTE_PATH_LIMIT); len(got) != len(simplifyPath(samplePath, 5)) {
+		t.Errorf("a short path was simplified to %v", got)
+	}
+}
+
+func TestRouteQueryPayload(t *testing.T) {
+	q := routeQuery{
+		From:     samplePath[0],
+		To:       samplePath[len(samplePath)-1],
+		Filter:   parseCafeFilter("wifi"),
+		Offset:   10,
+		PageSize: 5,
+		Path:     samplePath,
+	}
+	payload := q.payload("FIND_CAFE_ROUTE")
+	args := strings.Split(payload, ":")
+	if args[0] != "FIND_CAFE_ROUTE" {
+		t.Fatalf("got payload %q", payload)
+	}
+	got, err := parseRouteQuery(args[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the path is kept to the 5 decimals of a polyline
+	if len(got.Path) != len(q.Path) {
+		t.Fatalf("got path %v, want %v", got.Path, q.Path)
+	}
+	for i, p := range got.Path {
+		if math.Abs(p.Lat-q.Path[i].Lat) > 1e-5 || math.Abs(p.Lng-q.Path[i].Lng) > 1e-5 {
+			t.Errorf("got point %v, want %v", p, q.Path[i])
+		}
+	}
+	got.Path, q.Path = nil, nil
+	if !reflect.DeepEqual(got, q) {
+		t.Errorf("got %+v, want %+v", got, q)
+	}
+}
+
+func TestRouteSearchPagesWithoutDirections(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	defer useSampleCafes(t)()
+	savedConfig := config
+	config = testConfig()
+	config.GoogleMapsAPIKey = "test-maps-key"
+	defer func() { config = savedConfig }()
+	client := &fakeMapsClient{routes: []maps.Route{{OverviewPolyline: maps.Polyline{Points: maps.Encode(samplePath)}}}}
+	defer useFakeMapsClient(client)()
+	a := newFakeAmbassador()
+
+	q := routeQuery{From: samplePath[0], To: samplePath[len(samplePath)-1], PageSize: 1}
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatal("the pages never end")
+		}
+		if err := replyCafesAlongRoute(ctx, a, "walker", q); err != nil {
+			t.Fatal(err)
+		}
+		replies := a.lastReplies("walker")
+		if len(replies) == 0 {
+			break
+		}
+		args := strings.Split(replies[0]["payload"], ":")
+		if args[0] != "FIND_CAFE_ROUTE" {
+			t.Fatalf("got payload %q", replies[0]["payload"])
+		}
+		if q, err = parseRouteQuery(args[1:]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if client.directions != 1 {
+		t.Errorf("asked Google for directions %d times, want once", client.directions)
+	}
+	names := []string{}
+	for _, item := range carouselItems(a, "walker") {
+		names = append(names, item["title"].(string))
+		subtitle := item["subtitle"].(string)
+		if !strings.HasPrefix(subtitle, "離路線 ") || strings.Contains(subtitle, "步行") {
+			t.Errorf("%s: got subtitle %q, want the distance off the route", item["title"], subtitle)
+		}
+	}
+	if want := []string{"西門範例咖啡", "車站範例咖啡", "中山範例咖啡"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got cafes %v, want %v", names, want)
+	}
+}
@@ -0,0 +1,157 @@
+package cafehunter
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// cafeQuery is what the user asked to search for. It is carried in postback
+// payloads so that a quick reply can run the same search again.
+type cafeQuery struct {
+	Latitude  float64
+	Longitude float64
+	Filter    CafeFilter
+	Profile   string
+
+	// Radius fixes the search radius instead of widening it, and Offset is
+	// the first cafe shown, so that a page of an earlier search can be sent.
+	Radius float64
+	Offset int
+
+	// PageSize is how many cafes are shown at a time, PAGE_SIZE when zero.
+	PageSize int
+}
+
+func (q cafeQuery) pageSize() int {
+	if q.PageSize <= 0 || q.PageSize > PAGE_SIZE {
+		return PAGE_SIZE
+	}
+	return q.PageSize
+}
+
+// payload encodes the query after command as "COMMAND:lat,lng[:options]".
+func (q cafeQuery) payload(command string) string {
+	p := fmt.Sprintf("%s:%f,%f", command, q.Latitude, q.Longitude)
+
+	options := url.Values{}
+	if len(q.Filter) > 0 {
+		options.Set("f", q.Filter.String())
+	}
+	if q.Profile != "" {
+		options.Set("p", q.Profile)
+	}
+	if q.Radius > 0 {
+		options.Set("r", strconv.FormatFloat(q.Radius, 'f', 0, 64))
+	}
+	if q.Offset > 0 {
+		options.Set("o", strconv.Itoa(q.Offset))
+	}
+	if q.PageSize > 0 {
+		options.Set("n", strconv.Itoa(q.PageSize))
+	}
+	if len(options) > 0 {
+		p += ":" + options.Encode()
+	}
+	return p
+}
+
+// parseCafeQuery decodes the arguments following the command of a payload
+// written by cafeQuery.payload.
+func parseCafeQuery(args []string) (q cafeQuery, err error) {
+	if len(args) == 0 {
+		return q, fmt.Errorf("missing coordinates")
+	}
+
+	latlng := strings.Split(args[0], ",")
+	if len(latlng) != 2 {
+		return q, fmt.Errorf("invalid coordinates: %s", args[0])
+	}
+	if q.Latitude, err = strconv.ParseFloat(latlng[0], 64); err != nil {
+		return
+	}
+	if q.Longitude, err = strconv.ParseFloat(latlng[1], 64); err != nil {
+		return
+	}
+
+	if len(args) > 1 {
+		var options url.Values
+		if options, err = url.ParseQuery(args[1]); err != nil {
+			return
+		}
+		q.Filter = parseCafeFilter(options.Get("f"))
+		if p := findScoringProfile(options.Get("p")); p != nil {
+			q.Profile = p.Name
+		}
+		if r := options.Get("r"); r != "" {
+			if q.Radius, err = strconv.ParseFloat(r, 64); err != nil {
+				return
+			}
+		}
+		if o := options.Get("o"); o != "" {
+			if q.Offset, err = strconv.Atoi(o); err != nil {
+				return
+			}
+		}
+		if n := options.Get("n"); n != "" {
+			if q.PageSize, err = strconv.Atoi(n); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// cafeSearch is the outcome of a cafeQuery.
+type cafeSearch struct {
+	Query  cafeQuery
+	Radius float64
+	Cafes  []Cafe
+}
+
+// searchCafes looks for cafes matching a query, starting at the configured
+// search radius and doubling it, which also coarsens the geohash cells that
+// are queried, until enough cafes are found or the maximum radius is reached.
+// The cafes are nearest first unless the query names a scoring profile. A
+// query with a radius is searched within that radius only.
+func searchCafes(ctx context.Context, q cafeQuery) (*cafeSearch, error) {
+	search := &cafeSearch{
+		Query:  q,
+		Radius: config.SearchRadius,
+	}
+	if q.Radius > 0 {
+		search.Radius = q.Radius
+	}
+
+	for {
+		cafes, err := findCafeByGeocoding(ctx, q.Latitude, q.Longitude, search.Radius)
+		if err != nil {
+			return nil, err
+		}
+		cafes = q.Filter.Apply(cafes)
+		search.Cafes = cafes
+
+		if q.Radius > 0 || len(cafes) >= config.MinSearchResults || search.Radius >= config.MaxSearchRadius {
+			if p := findScoringProfile(q.Profile); p != nil {
+				search.Cafes = rankCafes(search.Cafes, *p)
+			}
+			return search, nil
+		}
+
+		search.Radius *= 2
+		if search.Radius > config.MaxSearchRadius {
+			search.Radius = config.MaxSearchRadius
+		}
+	}
+}
+
+// radiusText describes a search radius for the user.
+func radiusText(meters float64) string {
+	if meters >= 1000 {
+		return fmt.Sprintf("%.1f 公里", meters/1000)
+	}
+	return fmt.Sprintf("%.0f 公尺", meters)
+}
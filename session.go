@@ -0,0 +1,208 @@
+package cafehunter
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+)
+
+// SessionStore keeps the conversation state of users between webhook calls.
+// Get returns a nil user without error when the sender has no session yet.
+// Active returns the sessions in the middle of a conversation, that is not
+// in STANDBY.
+type SessionStore interface {
+	Get(ctx context.Context, senderId string) (*User, error)
+	Put(ctx context.Context, user *User) error
+	Delete(ctx context.Context, senderId string) error
+	Active(ctx context.Context) ([]*User, error)
+}
+
+// activeStates returns the states of conversationEvents other than STANDBY.
+func activeStates() []string {
+	seen := map[string]bool{"STANDBY": true}
+	states := []string{}
+	for _, e := range conversationEvents {
+		for _, state := range append([]string{e.Dst}, e.Src...) {
+			if !seen[state] {
+				seen[state] = true
+				states = append(states, state)
+			}
+		}
+	}
+	sort.Strings(states)
+	return states
+}
+
+// expireIfIdle moves a user back to STANDBY when the conversation has been
+// idle for longer than timeout. It reports whether the state was reset.
+func (user *User) expireIfIdle(now time.Time, timeout time.Duration) bool {
+	if user.State == "STANDBY" || user.LastActive.IsZero() {
+		return false
+	}
+	if now.Sub(user.LastActive) < timeout {
+		return false
+	}
+	user.State = "STANDBY"
+	user.attachFSM()
+	return true
+}
+
+// expireSessionsHandler is called by cron to reset every idle conversation.
+// Only the sessions not in STANDBY are read.
+func expireSessionsHandler(cfg *Config, w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	users, err := sessions.Active(ctx)
+	if err != nil {
+		log.Errorf(ctx, "can not list sessions: %s", err.Error())
+		http.Error(w, "unable to list sessions", http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	idle := time.Duration(cfg.SessionIdleTimeout)
+	expired := 0
+	for _, u := range users {
+		if !u.expireIfIdle(now, idle) {
+			continue
+		}
+		if err := expireSession(ctx, u.Id, now, idle); err != nil {
+			log.Errorf(ctx, "can not expire session of user %s: %s", u.Id, err.Error())
+			continue
+		}
+		expired++
+	}
+
+	log.Infof(ctx, "%d of %d active sessions expired", expired, len(users))
+	fmt.Fprintf(w, "%d sessions expired", expired)
+}
+
+// expireSession reloads a session under its sender lock, so a message that
+// arrived meanwhile is not overwritten, and stores it back if still idle.
+func expireSession(ctx context.Context, senderId string, now time.Time, idle time.Duration) error {
+	userLocks.Lock(senderId)
+	defer userLocks.Unlock(senderId)
+
+	user, err := sessions.Get(ctx, senderId)
+	if err != nil || user == nil {
+		return err
+	}
+	if !user.expireIfIdle(now, idle) {
+		return nil
+	}
+	return sessions.Put(ctx, user)
+}
+
+// newSessionStore returns the SessionStore selected by cfg.SessionStore.
+func newSessionStore(cfg *Config) SessionStore {
+	if cfg.SessionStore == "memory" {
+		return newMemorySessionStore()
+	}
+	return &firebaseSessionStore{}
+}
+
+// memorySessionStore keeps sessions in the memory of a single instance.
+type memorySessionStore struct {
+	mu    sync.Mutex
+	users map[string]User
+}
+
+func newMemorySessionStore() *memorySessionStore {
+	return &memorySessionStore{users: map[string]User{}}
+}
+
+func (s *memorySessionStore) Get(ctx context.Context, senderId string) (*User, error) {
+	s.mu.Lock()
+	u, ok := s.users[senderId]
+	s.mu.Unlock()
+	if !ok {
+		return nil, nil
+	}
+	user := &u
+	user.attachFSM()
+	return user, nil
+}
+
+func (s *memorySessionStore) Put(ctx context.Context, user *User) error {
+	u := *user
+	u.FSM = nil
+	s.mu.Lock()
+	s.users[user.Id] = u
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *memorySessionStore) Delete(ctx context.Context, senderId string) error {
+	s.mu.Lock()
+	delete(s.users, senderId)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *memorySessionStore) Active(ctx context.Context) ([]*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	users := []*User{}
+	for _, u := range s.users {
+		if u.State == "" || u.State == "STANDBY" {
+			continue
+		}
+		user := u
+		user.attachFSM()
+		users = append(users, &user)
+	}
+	return users, nil
+}
+
+// firebaseSessionStore keeps sessions under the "users" path of Firebase so
+// they are shared by every instance and survive restarts.
+type firebaseSessionStore struct{}
+
+func (s *firebaseSessionStore) Get(ctx context.Context, senderId string) (*User, error) {
+	var user *User
+	if err := newFirebaseClient(ctx).Child("users").Child(senderId).Value(&user); err != nil {
+		return nil, err
+	}
+	if user == nil || user.Id == "" {
+		return nil, nil
+	}
+	user.attachFSM()
+	return user, nil
+}
+
+func (s *firebaseSessionStore) Put(ctx context.Context, user *User) error {
+	return newFirebaseClient(ctx).Child("users").Child(user.Id).Set(user)
+}
+
+func (s *firebaseSessionStore) Delete(ctx context.Context, senderId string) error {
+	return newFirebaseClient(ctx).Child("users").Child(senderId).Remove()
+}
+
+// Active queries the users in each state other than STANDBY, which most
+// users are in, so the sessions of idle users are never downloaded.
+func (s *firebaseSessionStore) Active(ctx context.Context) ([]*User, error) {
+	firegoClient := newFirebaseClient(ctx)
+
+	users := []*User{}
+	for _, state := range activeStates() {
+		v := map[string]*User{}
+		if err := firegoClient.Child("users").OrderBy("state").EqualTo(state).Value(&v); err != nil {
+			return nil, fmt.Errorf("can not fetch sessions in %s: %s", state, err)
+		}
+		for _, user := range v {
+			if user == nil || user.Id == "" {
+				continue
+			}
+			user.attachFSM()
+			users = append(users, user)
+		}
+	}
+	return users, nil
+}
@@ -0,0 +1,83 @@
+package cafehunter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/aetest"
+)
+
+func TestActiveStates(t *testing.T) {
+	states := activeStates()
+	has := map[string]bool{}
+	for _, s := range states {
+		has[s] = true
+	}
+	if has["STANDBY"] {
+		t.Error("STANDBY is taken as active")
+	}
+	for _, s := range []string{"INTENT_CONFIRMED", "UNSURE_LOCATION", "SETTING_HOME", "SUBMIT_RATING", "UNKNOWN_LOCATION"} {
+		if !has[s] {
+			t.Errorf("%s is missing from %v", s, states)
+		}
+	}
+	if len(has) != len(states) {
+		t.Errorf("got duplicated states %v", states)
+	}
+}
+
+func TestExpireSessions(t *testing.T) {
+	inst, err := aetest.NewInstance(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inst.Close()
+
+	store, restore := useMemorySessions()
+	defer restore()
+	cfg := testConfig()
+	idle := time.Duration(cfg.SessionIdleTimeout)
+	ctx := context.Background()
+	now := time.Now()
+	for _, u := range []User{
+		{Id: "resting", State: "STANDBY", LastActive: now.Add(-2 * idle)},
+		{Id: "gone", State: "SUBMIT_PLUG", LastActive: now.Add(-2 * idle)},
+		{Id: "typing", State: "SETTING_HOME", LastActive: now},
+		{Id: "new", State: ""},
+	} {
+		user := u
+		store.Put(ctx, &user)
+	}
+
+	active, err := store.Active(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []string{}
+	for _, u := range active {
+		ids = append(ids, u.Id)
+	}
+	sort.Strings(ids)
+	if len(ids) != 2 || ids[0] != "gone" || ids[1] != "typing" {
+		t.Errorf("got active sessions %v, want gone and typing", ids)
+	}
+
+	r, err := inst.NewRequest("GET", "/tasks/expireSessions", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	expireSessionsHandler(cfg, w, r)
+	if w.Code != http.StatusOK || w.Body.String() != "1 sessions expired" {
+		t.Fatalf("got %d %q", w.Code, w.Body.String())
+	}
+	for id, want := range map[string]string{"resting": "STANDBY", "gone": "STANDBY", "typing": "SETTING_HOME"} {
+		if u, _ := store.Get(ctx, id); u == nil || u.State != want {
+			t.Errorf("%s: got %+v, want %s", id, u, want)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package cafehunter
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"net/http"
+	"strings"
+)
+
+// validSignature checks the HMAC Facebook attaches to every webhook POST.
+// X-Hub-Signature-256 is preferred; X-Hub-Signature (SHA1) is accepted for
+// older deliveries. Payloads are never trusted without a configured secret.
+func validSignature(header http.Header, body []byte, secret string) bool {
+	if secret == "" {
+		return false
+	}
+	if sig := header.Get("X-Hub-Signature-256"); sig != "" {
+		return checkHMAC(sha256.New, "sha256=", sig, body, secret)
+	}
+	if sig := header.Get("X-Hub-Signature"); sig != "" {
+		return checkHMAC(sha1.New, "sha1=", sig, body, secret)
+	}
+	return false
+}
+
+func checkHMAC(h func() hash.Hash, prefix, sig string, body []byte, secret string) bool {
+	if !strings.HasPrefix(sig, prefix) {
+		return false
+	}
+	expected, err := hex.DecodeString(strings.TrimPrefix(sig, prefix))
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(h, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
@@ -0,0 +1,95 @@
+package cafehunter
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"google.golang.org/appengine/aetest"
+)
+
+func TestValidSignature(t *testing.T) {
+	body := []byte(`{"object":"page","entry":[]}`)
+	sha1Signature := func(secret string) string {
+		mac := hmac.New(sha1.New, []byte(secret))
+		mac.Write(body)
+		return "sha1=" + hex.EncodeToString(mac.Sum(nil))
+	}
+
+	for _, c := range []struct {
+		name   string
+		header map[string]string
+		secret string
+		valid  bool
+	}{
+		{"valid sha256", map[string]string{"X-Hub-Signature-256": sign(body, "secret")}, "secret", true},
+		{"valid sha1", map[string]string{"X-Hub-Signature": sha1Signature("secret")}, "secret", true},
+		{"sha256 preferred over sha1", map[string]string{
+			"X-Hub-Signature-256": sign(body, "secret"),
+			"X-Hub-Signature":     sha1Signature("other"),
+		}, "secret", true},
+		{"wrong secret sha256", map[string]string{"X-Hub-Signature-256": sign(body, "other")}, "secret", false},
+		{"wrong secret sha1", map[string]string{"X-Hub-Signature": sha1Signature("other")}, "secret", false},
+		{"missing header", map[string]string{}, "secret", false},
+		{"malformed hex", map[string]string{"X-Hub-Signature-256": "sha256=not-hex"}, "secret", false},
+		{"missing prefix", map[string]string{"X-Hub-Signature-256": sign(body, "secret")[len("sha256="):]}, "secret", false},
+		{"sha1 under the sha256 header", map[string]string{"X-Hub-Signature-256": sha1Signature("secret")}, "secret", false},
+		{"empty secret", map[string]string{"X-Hub-Signature-256": sign(body, "")}, "", false},
+	} {
+		header := http.Header{}
+		for k, v := range c.header {
+			header.Set(k, v)
+		}
+		if got := validSignature(header, body, c.secret); got != c.valid {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.valid)
+		}
+	}
+}
+
+func TestCallbackRejectsInvalidSignature(t *testing.T) {
+	inst, err := aetest.NewInstance(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inst.Close()
+
+	a := newFakeAmbassador()
+	defer useFakeAmbassador(a)()
+	_, restore := useMemorySessions()
+	defer restore()
+	cfg := testConfig()
+
+	messages := []testMessage{{Sender: "user", Text: "hi"}}
+	for _, c := range []struct {
+		name   string
+		secret string
+		status int
+	}{
+		{"valid", TEST_APP_SECRET, http.StatusOK},
+		{"wrong secret", "other", http.StatusForbidden},
+	} {
+		w := httptest.NewRecorder()
+		fbCBHandler(cfg, w, newCallback(t, inst, messages, c.secret))
+		if w.Code != c.status {
+			t.Errorf("%s: got status %d, want %d", c.name, w.Code, c.status)
+		}
+	}
+
+	r, err := inst.NewRequest("POST", "/fbCallback", strings.NewReader(`[{"sender":"user","text":"hi"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	fbCBHandler(cfg, w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("unsigned: got status %d, want %d", w.Code, http.StatusForbidden)
+	}
+
+	if got := a.texts("user"); len(got) != 1 || got[0] != WELCOME_TEXT {
+		t.Errorf("only the signed message should be answered, got %q", got)
+	}
+}
@@ -0,0 +1,115 @@
+package cafehunter
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/lemonlatte/ambassador"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/log"
+)
+
+const (
+	SIMILAR_RADIUS     = 2000.0 // meters around the cafe similar ones are looked for
+	MIN_SIMILARITY     = 0.7
+	MIN_SHARED_RATINGS = 3
+)
+
+// similarKeywords are the words asking for cafes like the last one seen.
+var similarKeywords = []string{"像這家", "像這間", "類似的", "相似的", "差不多的"}
+
+func isSimilarQuestion(message string) bool {
+	for _, k := range similarKeywords {
+		if strings.Contains(message, k) {
+			return true
+		}
+	}
+	return false
+}
+
+func ratingVector(c Cafe) []float64 {
+	return []float64{c.Wifi, c.Seat, c.Quiet, c.Tasty, c.Price, c.Music}
+}
+
+// similarity compares the ratings two cafes both have, from 0 for opposite
+// ratings to 1 for equal ones. Cafes sharing fewer than MIN_SHARED_RATINGS
+// ratings are not comparable and score 0.
+func similarity(a, b Cafe) float64 {
+	va, vb := ratingVector(a), ratingVector(b)
+	shared, sum := 0, 0.0
+	for i := range va {
+		if va[i] <= 0 || vb[i] <= 0 {
+			continue
+		}
+		shared++
+		sum += (va[i] - vb[i]) * (va[i] - vb[i])
+	}
+	if shared < MIN_SHARED_RATINGS {
+		return 0
+	}
+	// ratings range from 1 to 5, so two ratings differ by 4 at most
+	return 1 - math.Sqrt(sum/float64(shared))/4
+}
+
+// rankBySimilarity returns the cafes at least MIN_SIMILARITY alike to a
+// cafe, most alike first. Cafes as alike keep their order, which is nearest
+// first after a search.
+func rankBySimilarity(source Cafe, cafes []Cafe) []Cafe {
+	scores := map[string]float64{}
+	similar := []Cafe{}
+	for _, c := range cafes {
+		if c.Id == source.Id {
+			continue
+		}
+		if s := similarity(source, c); s >= MIN_SIMILARITY {
+			scores[c.Id] = s
+			similar = append(similar, c)
+		}
+	}
+	sort.SliceStable(similar, func(i, j int) bool {
+		return scores[similar[i].Id] > scores[similar[j].Id]
+	})
+	return similar
+}
+
+// replySimilarCafes answers SIMILAR_TO with the cafes around a cafe rated
+// like it.
+func replySimilarCafes(ctx context.Context, a ambassador.Ambassador, user *User, id string) (err error) {
+	source, err := findCafe(ctx, a, user.Id, id)
+	if source == nil {
+		return err
+	}
+	user.LastCafe = source.Id
+
+	nearby, err := findCafeByGeocoding(ctx, source.Latitude, source.Longitude, SIMILAR_RADIUS)
+	if err != nil {
+		log.Errorf(ctx, "can not fetch cafes near %s: %s", source.Id, err)
+		return a.SendText(user.Id, "查詢咖啡店時發生錯誤，請稍後再試")
+	}
+
+	size := user.Preferences.pageSize()
+	similar := withReviews(ctx, rankBySimilarity(*source, nearby), 0, size)
+	if len(similar) == 0 {
+		return a.SendText(user.Id, fmt.Sprintf("方圓 %s 內沒有和「%s」相似的咖啡店。", radiusText(SIMILAR_RADIUS), source.Name))
+	}
+
+	_, items, n := cafeToFBTemplate(similar, 0, size, searchResultButtons)
+	if n > size {
+		n = size
+	}
+	if err = a.SendText(user.Id, fmt.Sprintf("方圓 %s 內和「%s」最相似的 %d 家咖啡店：", radiusText(SIMILAR_RADIUS), source.Name, n)); err != nil {
+		return
+	}
+	return a.SendTemplate(user.Id, items)
+}
+
+// similarTextHandler answers "有沒有像這家的" about the cafe the user last
+// looked at.
+func similarTextHandler(ctx context.Context, user *User, a ambassador.Ambassador) error {
+	if user.LastCafe == "" {
+		return a.SendText(user.Id, "是像哪一家呢？在咖啡店上按「找相似的」就可以囉。")
+	}
+	return replySimilarCafes(ctx, a, user, user.LastCafe)
+}
@@ -0,0 +1,95 @@
+package cafehunter
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+
+	"google.golang.org/appengine/aetest"
+)
+
+// rated returns a cafe with the ratings of ratingVector.
+func rated(id string, wifi, seat, quiet, tasty, price, music float64) Cafe {
+	return Cafe{Id: id, Name: id, Wifi: wifi, Seat: seat, Quiet: quiet, Tasty: tasty, Price: price, Music: music}
+}
+
+func TestSimilarity(t *testing.T) {
+	source := rated("source", 4, 4, 4, 4, 4, 4)
+	for _, c := range []struct {
+		cafe Cafe
+		want float64
+	}{
+		{rated("identical", 4, 4, 4, 4, 4, 4), 1},
+		// every rating one star apart: 1 - 1/4
+		{rated("near", 5, 3, 5, 3, 5, 3), 0.75},
+		// one rating two stars apart: 1 - sqrt(4/6)/4
+		{rated("one off", 4, 4, 4, 4, 4, 2), 1 - math.Sqrt(4.0/6)/4},
+		{rated("far", 1, 1, 1, 1, 1, 1), 1 - 3.0/4},
+		// unrated aspects are left out of the comparison
+		{rated("half rated", 4, 4, 4, 0, 0, 0), 1},
+		{rated("barely rated", 4, 4, 0, 0, 0, 0), 0},
+	} {
+		if got := similarity(source, c.cafe); math.Abs(got-c.want) > 1e-9 {
+			t.Errorf("%s: got %v, want %v", c.cafe.Id, got, c.want)
+		}
+	}
+	if got := similarity(rated("low", 1, 1, 1, 1, 1, 1), rated("high", 5, 5, 5, 5, 5, 5)); got != 0 {
+		t.Errorf("opposite cafes: got %v, want 0", got)
+	}
+}
+
+func TestRankBySimilarity(t *testing.T) {
+	source := rated("source", 4, 4, 4, 4, 4, 4)
+	cafes := []Cafe{
+		rated("near", 5, 3, 5, 3, 5, 3),         // 0.75
+		source,                                  // the cafe itself
+		rated("identical", 4, 4, 4, 4, 4, 4),    // 1
+		rated("below", 5, 5, 5, 5, 5, 2),        // 1 - sqrt(9/6)/4 ≈ 0.694
+		rated("as near", 3, 5, 3, 5, 3, 5),      // 0.75, after near
+		rated("barely rated", 4, 4, 0, 0, 0, 0), // not comparable
+		rated("far", 1, 1, 1, 1, 1, 1),          // 0.25
+		rated("one off", 4, 4, 4, 4, 4, 2),      // ≈ 0.796
+	}
+	want := []string{"identical", "one off", "near", "as near"}
+	if got := cafeIds(rankBySimilarity(source, cafes)); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestReplySimilarCafes(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	defer useSampleCafes(t)()
+	at := func(c Cafe, lat, lng float64) Cafe {
+		c.Latitude, c.Longitude = lat, lng
+		return c
+	}
+	cafeRepo = newMemoryCafeRepository([]Cafe{
+		at(rated("source", 4, 4, 4, 4, 4, 4), 25.0400, 121.5000),
+		at(rated("alike", 4, 4, 4, 4, 4, 5), 25.0450, 121.5000),
+		at(rated("unlike", 1, 5, 1, 5, 1, 5), 25.0410, 121.5000),
+		// about 3 km north, beyond SIMILAR_RADIUS
+		at(rated("elsewhere", 4, 4, 4, 4, 4, 4), 25.0670, 121.5000),
+	})
+
+	a := newFakeAmbassador()
+	user := newUser("u")
+	if err := replySimilarCafes(ctx, a, user, "source"); err != nil {
+		t.Fatal(err)
+	}
+	texts := a.texts("u")
+	if len(texts) != 2 || !strings.Contains(texts[0], "最相似的 1 家") {
+		t.Fatalf("got %q", texts)
+	}
+	if !strings.Contains(texts[1], `"title":"alike"`) || strings.Contains(texts[1], "elsewhere") || strings.Contains(texts[1], `"title":"source"`) {
+		t.Errorf("got carousel %s, want alike only", texts[1])
+	}
+	if user.LastCafe != "source" {
+		t.Errorf("got last cafe %q", user.LastCafe)
+	}
+}
@@ -0,0 +1,460 @@
+package cafehunter
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lemonlatte/ambassador"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+)
+
+const (
+	SUBMISSION_DUPLICATE_RADIUS = 100.0 // meters within which a cafe of the same name is the same cafe
+	MAX_CAFE_NAME_LENGTH        = 50
+)
+
+// cafeSubmission is a cafe a user told us about. It is drafted on the user
+// during the "新增咖啡店" conversation, then kept pending until an admin
+// approves it into the cafe repository or rejects it.
+type cafeSubmission struct {
+	Id          string     `json:"id"`
+	SenderId    string     `json:"senderId"`
+	Name        string     `json:"name"`
+	Latitude    float64    `json:"lat"`
+	Longitude   float64    `json:"lng"`
+	Plug        string     `json:"plug"`
+	TimeLimited string     `json:"timeLimited"`
+	Ratings     userRating `json:"ratings"`
+	Status      string     `json:"status"`
+	Time        time.Time  `json:"time"`
+
+	// CafeId is the id of the cafe an approved submission became.
+	CafeId string `json:"cafeId,omitempty"`
+
+	// Step is the index in ratingAspects of the rating asked while drafting.
+	Step int `json:"step,omitempty"`
+}
+
+// cafe builds the cafe record of a submission. The ratings of the submitter
+// are stored as a user rating rather than as imported ones.
+func (s cafeSubmission) cafe() Cafe {
+	return Cafe{
+		Name:        s.Name,
+		Latitude:    s.Latitude,
+		Longitude:   s.Longitude,
+		Plug:        s.Plug,
+		TimeLimited: s.TimeLimited,
+		Source:      "user",
+	}
+}
+
+// SubmissionStore keeps the cafes users submitted. ByID returns a nil
+// submission without error when there is none of the given id.
+type SubmissionStore interface {
+	Put(ctx context.Context, s cafeSubmission) error
+	ByID(ctx context.Context, id string) (*cafeSubmission, error)
+	List(ctx context.Context) ([]cafeSubmission, error)
+}
+
+var submissions SubmissionStore
+
+// newSubmissionStore keeps submissions next to the cafes, like the audit log.
+func newSubmissionStore(cfg *Config) SubmissionStore {
+	if cfg.CafeDataFile != "" {
+		return &memorySubmissionStore{submissions: map[string]cafeSubmission{}}
+	}
+	return &firebaseSubmissionStore{}
+}
+
+// memorySubmissionStore keeps the submissions of a single instance.
+type memorySubmissionStore struct {
+	mu          sync.Mutex
+	submissions map[string]cafeSubmission
+}
+
+func (m *memorySubmissionStore) Put(ctx context.Context, s cafeSubmission) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.submissions[s.Id] = s
+	return nil
+}
+
+func (m *memorySubmissionStore) ByID(ctx context.Context, id string) (*cafeSubmission, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.submissions[id]
+	if !ok {
+		return nil, nil
+	}
+	return &s, nil
+}
+
+func (m *memorySubmissionStore) List(ctx context.Context) ([]cafeSubmission, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := make([]cafeSubmission, 0, len(m.submissions))
+	for _, s := range m.submissions {
+		list = append(list, s)
+	}
+	return list, nil
+}
+
+// firebaseSubmissionStore keeps submissions under "submissions/<id>".
+type firebaseSubmissionStore struct{}
+
+func (f *firebaseSubmissionStore) Put(ctx context.Context, s cafeSubmission) error {
+	return newFirebaseClient(ctx).Child("submissions").Child(s.Id).Set(s)
+}
+
+func (f *firebaseSubmissionStore) ByID(ctx context.Context, id string) (*cafeSubmission, error) {
+	var s *cafeSubmission
+	if err := newFirebaseClient(ctx).Child("submissions").Child(id).Value(&s); err != nil {
+		return nil, err
+	}
+	if s == nil || s.Id == "" {
+		return nil, nil
+	}
+	return s, nil
+}
+
+func (f *firebaseSubmissionStore) List(ctx context.Context) ([]cafeSubmission, error) {
+	v := map[string]cafeSubmission{}
+	if err := newFirebaseClient(ctx).Child("submissions").Value(&v); err != nil {
+		return nil, err
+	}
+	list := make([]cafeSubmission, 0, len(v))
+	for _, s := range v {
+		list = append(list, s)
+	}
+	return list, nil
+}
+
+// cafeNameKey is how names are compared to find a cafe submitted twice,
+// ignoring case and spaces.
+func cafeNameKey(name string) string {
+	name = strings.ToLower(strings.Join(strings.Fields(name), ""))
+	return strings.Replace(name, "臺", "台", -1)
+}
+
+// duplicateCafe returns the cafe of the same name near a point, or nil.
+func duplicateCafe(ctx context.Context, name string, lat, lng float64) (*Cafe, error) {
+	nearby, err := findCafeByGeocoding(ctx, lat, lng, SUBMISSION_DUPLICATE_RADIUS)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range nearby {
+		if cafeNameKey(c.Name) == cafeNameKey(name) {
+			return &c, nil
+		}
+	}
+	return nil, nil
+}
+
+func submissionReply(title, payload string) map[string]string {
+	return map[string]string{"content_type": "text", "title": title, "payload": payload}
+}
+
+// startSubmission begins the "新增咖啡店" conversation.
+func startSubmission(a ambassador.Ambassador, user *User) error {
+	user.FSM.Event("startSubmission")
+	user.Submission = &cafeSubmission{SenderId: user.Id}
+	return askSubmissionStep(a, user)
+}
+
+// askSubmissionStep asks what the conversation is at, again when the user
+// answered something else.
+func askSubmissionStep(a ambassador.Ambassador, user *User) error {
+	cancel := submissionReply("取消", "CANCEL")
+	s := user.Submission
+
+	switch user.State {
+	case "SUBMIT_NAME":
+		return a.AskQuestion(user.Id, "謝謝你幫忙新增咖啡店！請問店名是？", []map[string]string{cancel})
+	case "SUBMIT_LOCATION":
+		return a.AskQuestion(user.Id, fmt.Sprintf("「%s」在哪裡呢？請用下方按鈕標記位置", s.Name), []map[string]string{
+			map[string]string{"content_type": "location"},
+			cancel,
+		})
+	case "SUBMIT_PLUG":
+		return a.AskQuestion(user.Id, "有插座嗎？", []map[string]string{
+			submissionReply("很多", "SUBMIT_PLUG:yes"),
+			submissionReply("部分座位有", "SUBMIT_PLUG:maybe"),
+			submissionReply("沒有", "SUBMIT_PLUG:no"),
+			submissionReply("不確定", "SUBMIT_PLUG:"),
+			cancel,
+		})
+	case "SUBMIT_TIME_LIMIT":
+		return a.AskQuestion(user.Id, "有限時嗎？", []map[string]string{
+			submissionReply("有限時", "SUBMIT_TIME_LIMIT:yes"),
+			submissionReply("看情況", "SUBMIT_TIME_LIMIT:maybe"),
+			submissionReply("不限時", "SUBMIT_TIME_LIMIT:no"),
+			submissionReply("不確定", "SUBMIT_TIME_LIMIT:"),
+			cancel,
+		})
+	case "SUBMIT_RATING":
+		if s.Step < 0 || s.Step >= len(ratingAspects) {
+			s.Step = 0
+		}
+		aspect := ratingAspects[s.Step]
+		replies := []map[string]string{}
+		for v := 1; v <= 5; v++ {
+			replies = append(replies, submissionReply(strings.Repeat("🌟", v), fmt.Sprintf("SUBMIT_RATING:%s:%d", aspect.Key, v)))
+		}
+		replies = append(replies, submissionReply("跳過", fmt.Sprintf("SUBMIT_RATING:%s:0", aspect.Key)), cancel)
+		return a.AskQuestion(user.Id, fmt.Sprintf("%s給幾顆星？", aspect.Title), replies)
+	}
+	return nil
+}
+
+// cancelSubmission drops the draft of a user.
+func cancelSubmission(a ambassador.Ambassador, user *User) error {
+	user.FSM.Event("cancel")
+	user.Submission = nil
+	return a.SendText(user.Id, "好，已取消新增咖啡店。")
+}
+
+// submissionHandler handles messages during the "新增咖啡店" conversation.
+func submissionHandler(ctx context.Context, cfg *Config, user *User, msg ambassador.Message, a ambassador.Ambassador) (err error) {
+	if user.Submission == nil {
+		// the draft is gone, e.g. the session was reset meanwhile
+		user.FSM.Event("cancel")
+		return standbyHandler(ctx, cfg, user, msg, a)
+	}
+	s := user.Submission
+
+	switch msgContent := msg.Content.(type) {
+	case *ambassador.TextContent:
+		text := strings.TrimSpace(msgContent.Text)
+		if text == "取消" || text == "算了" {
+			return cancelSubmission(a, user)
+		}
+		if user.State != "SUBMIT_NAME" {
+			return askSubmissionStep(a, user)
+		}
+		if text == "" || len([]rune(text)) > MAX_CAFE_NAME_LENGTH {
+			return a.SendText(user.Id, fmt.Sprintf("店名請在 %d 個字以內", MAX_CAFE_NAME_LENGTH))
+		}
+		s.Name = text
+		user.FSM.Event("submitName")
+		err = askSubmissionStep(a, user)
+	case *ambassador.LocationContent:
+		if user.State != "SUBMIT_LOCATION" {
+			return askSubmissionStep(a, user)
+		}
+		var dup *Cafe
+		if dup, err = duplicateCafe(ctx, s.Name, msgContent.Lat, msgContent.Lon); err != nil {
+			log.Errorf(ctx, "can not look for cafes like %s: %s", s.Name, err)
+			return a.SendText(user.Id, "查詢咖啡店時發生錯誤，請稍後再試")
+		}
+		if dup != nil {
+			user.FSM.Event("cancel")
+			user.Submission = nil
+			return a.AskQuestion(user.Id, fmt.Sprintf("「%s」已經在我的資料裡了，謝謝你！", dup.Name), []map[string]string{
+				submissionReply("看看這家", fmt.Sprintf("CAFE_DETAIL:%s", dup.Id)),
+			})
+		}
+		s.Latitude, s.Longitude = msgContent.Lat, msgContent.Lon
+		user.FSM.Event("submitLocation")
+		err = askSubmissionStep(a, user)
+	case *ambassador.CommandContent:
+		items := strings.Split(msgContent.Payload, ":")
+		switch {
+		case items[0] == "CANCEL":
+			err = cancelSubmission(a, user)
+		case items[0] == "SUBMIT_PLUG" && user.State == "SUBMIT_PLUG" && len(items) == 2:
+			s.Plug = items[1]
+			user.FSM.Event("submitPlug")
+			err = askSubmissionStep(a, user)
+		case items[0] == "SUBMIT_TIME_LIMIT" && user.State == "SUBMIT_TIME_LIMIT" && len(items) == 2:
+			s.TimeLimited = items[1]
+			s.Step = 0
+			user.FSM.Event("submitTimeLimit")
+			err = askSubmissionStep(a, user)
+		case items[0] == "SUBMIT_RATING" && user.State == "SUBMIT_RATING" && len(items) == 3 && s.Step < len(ratingAspects):
+			aspect := ratingAspects[s.Step]
+			if items[1] != aspect.Key {
+				// a reply to an earlier question
+				return askSubmissionStep(a, user)
+			}
+			if v, perr := strconv.Atoi(items[2]); perr == nil && v >= 1 && v <= 5 {
+				aspect.Set(&s.Ratings, float64(v))
+			}
+			if s.Step++; s.Step < len(ratingAspects) {
+				return askSubmissionStep(a, user)
+			}
+			err = finishSubmission(ctx, a, user)
+		case strings.HasPrefix(items[0], "SUBMIT_"):
+			err = askSubmissionStep(a, user)
+		default:
+			// any other postback, e.g. from an earlier carousel, leaves the draft
+			user.FSM.Event("cancel")
+			user.Submission = nil
+			err = commandHandler(ctx, user, msgContent.Payload, a)
+		}
+	}
+	return
+}
+
+// finishSubmission stores the draft of a user as pending.
+func finishSubmission(ctx context.Context, a ambassador.Ambassador, user *User) error {
+	s := *user.Submission
+	s.Id = newCafeId()
+	s.Status = "pending"
+	s.Time = time.Now()
+	s.Step = 0
+	s.Ratings.SenderId = user.Id
+
+	user.FSM.Event("submitted")
+	user.Submission = nil
+	if err := submissions.Put(ctx, s); err != nil {
+		log.Errorf(ctx, "can not save submission of %s: %s", user.Id, err)
+		return a.SendText(user.Id, "送出時發生錯誤，請稍後再試")
+	}
+	log.Infof(ctx, "user %s submitted cafe %s as %s", user.Id, s.Name, s.Id)
+	return a.SendText(user.Id, fmt.Sprintf("謝謝！「%s」審核通過後就會出現在搜尋結果裡。", s.Name))
+}
+
+// adminSubmissionsHandler serves the cafes users submitted:
+//
+//	GET  /admin/submissions?status=          list, pending ones by default
+//	GET  /admin/submissions/<id>             get
+//	POST /admin/submissions/<id>/approve     add to the cafes
+//	POST /admin/submissions/<id>/reject      reject
+//
+// The body of approve may hold cafe fields the user could not tell, such as
+// the address, and corrections.
+func adminSubmissionsHandler(cfg *Config, w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	if !adminAuthorized(cfg, r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/submissions"), "/"), "/")
+	if parts[0] == "" {
+		if r.Method != "GET" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		listSubmissions(ctx, w, r)
+		return
+	}
+
+	s, err := submissions.ByID(ctx, parts[0])
+	if err != nil {
+		log.Errorf(ctx, "can not get submission %s: %s", parts[0], err)
+		http.Error(w, "unable to get submission", http.StatusInternalServerError)
+		return
+	}
+	if s == nil {
+		http.Error(w, "submission not found", http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == "GET":
+		writeJSON(w, http.StatusOK, s)
+	case len(parts) == 2 && r.Method == "POST" && (parts[1] == "approve" || parts[1] == "reject"):
+		if s.Status != "pending" {
+			http.Error(w, fmt.Sprintf("submission is %s already", s.Status), http.StatusConflict)
+			return
+		}
+		if parts[1] == "approve" {
+			approveSubmission(ctx, cfg, w, r, s)
+		} else {
+			rejectSubmission(ctx, w, r, s)
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func listSubmissions(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	list, err := submissions.List(ctx)
+	if err != nil {
+		log.Errorf(ctx, "can not list submissions: %s", err)
+		http.Error(w, "unable to list submissions", http.StatusInternalServerError)
+		return
+	}
+
+	status := r.FormValue("status")
+	if status == "" {
+		status = "pending"
+	}
+	matched := []cafeSubmission{}
+	for _, s := range list {
+		if status == "all" || s.Status == status {
+			matched = append(matched, s)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool { return matched[i].Time.Before(matched[j].Time) })
+	writeJSON(w, http.StatusOK, map[string]interface{}{"total": len(matched), "submissions": matched})
+}
+
+// approveSubmission adds a submitted cafe, unless a cafe of the same name
+// has been added nearby meanwhile, and stores the ratings of the submitter.
+func approveSubmission(ctx context.Context, cfg *Config, w http.ResponseWriter, r *http.Request, s *cafeSubmission) {
+	cafe := s.cafe()
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&cafe); err != nil {
+			http.Error(w, fmt.Sprintf("invalid cafe: %s", err), http.StatusBadRequest)
+			return
+		}
+	}
+	cafe.Id = newCafeId()
+	cafe.Source = "user"
+
+	dup, err := duplicateCafe(ctx, cafe.Name, cafe.Latitude, cafe.Longitude)
+	if err != nil {
+		log.Errorf(ctx, "can not look for cafes like %s: %s", s.Id, err)
+		http.Error(w, "unable to approve submission", http.StatusInternalServerError)
+		return
+	}
+	if dup != nil {
+		http.Error(w, fmt.Sprintf("cafe %s has the same name nearby", dup.Id), http.StatusConflict)
+		return
+	}
+
+	if !saveCafe(ctx, w, r, "approve", nil, &cafe, http.StatusCreated) {
+		return
+	}
+
+	s.Status = "approved"
+	s.CafeId = cafe.Id
+	if err := submissions.Put(ctx, *s); err != nil {
+		log.Criticalf(ctx, "can not mark submission %s approved as cafe %s: %s", s.Id, cafe.Id, err)
+	}
+	if s.Ratings.Wifi+s.Ratings.Quiet+s.Ratings.Tasty+s.Ratings.Price > 0 {
+		rating := s.Ratings
+		rating.CafeId = cafe.Id
+		rating.SenderId = s.SenderId
+		rating.Time = s.Time
+		if err := ratings.Put(ctx, rating); err != nil {
+			log.Errorf(ctx, "can not save rating of submission %s: %s", s.Id, err)
+		}
+	}
+
+	a := newAmbassador(ctx, cfg)
+	if err := a.SendText(s.SenderId, fmt.Sprintf("你新增的「%s」已經通過審核，謝謝你！", cafe.Name)); err != nil {
+		log.Warningf(ctx, "can not tell %s submission %s is approved: %s", s.SenderId, s.Id, err)
+	}
+}
+
+func rejectSubmission(ctx context.Context, w http.ResponseWriter, r *http.Request, s *cafeSubmission) {
+	s.Status = "rejected"
+	if err := submissions.Put(ctx, *s); err != nil {
+		log.Errorf(ctx, "can not reject submission %s: %s", s.Id, err)
+		http.Error(w, "unable to reject submission", http.StatusInternalServerError)
+		return
+	}
+	log.Infof(ctx, "admin %s rejected submission %s", adminActor(r), s.Id)
+	writeJSON(w, http.StatusOK, s)
+}
@@ -0,0 +1,276 @@
+package cafehunter
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lemonlatte/ambassador"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/aetest"
+)
+
+// useMemorySubmissions starts the test with no submission and an empty audit
+// log, until the returned function restores them.
+func useMemorySubmissions() (*memorySubmissionStore, func()) {
+	savedSubmissions, savedAudit := submissions, auditLog
+	s := &memorySubmissionStore{submissions: map[string]cafeSubmission{}}
+	submissions, auditLog = s, &memoryAuditLog{}
+	return s, func() { submissions, auditLog = savedSubmissions, savedAudit }
+}
+
+func TestSubmission(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	defer useSampleCafes(t)()
+	sessionStore, restore := useMemorySessions()
+	defer restore()
+	store, restoreSubmissions := useMemorySubmissions()
+	defer restoreSubmissions()
+	cfg := testConfig()
+	a := newFakeAmbassador()
+	session := func() *User {
+		user, err := sessionStore.Get(context.Background(), "u")
+		if err != nil || user == nil {
+			t.Fatalf("no session saved: %v", err)
+		}
+		return user
+	}
+
+	handleMessage(ctx, cfg, say("新增咖啡店"), a)
+	if user := session(); user.State != "SUBMIT_NAME" || user.Submission == nil {
+		t.Fatalf("got state %s with %+v", user.State, user.Submission)
+	}
+
+	for _, name := range []string{strings.Repeat("咖", MAX_CAFE_NAME_LENGTH+1), "   "} {
+		handleMessage(ctx, cfg, say(name), a)
+		texts := a.texts("u")
+		if user := session(); user.State != "SUBMIT_NAME" || !strings.Contains(texts[len(texts)-1], "50 個字以內") {
+			t.Fatalf("name %q: got %s with %q", name, user.State, texts[len(texts)-1])
+		}
+	}
+	handleMessage(ctx, cfg, say(strings.Repeat("咖", MAX_CAFE_NAME_LENGTH)), a)
+	if user := session(); user.State != "SUBMIT_LOCATION" {
+		t.Fatalf("a name of %d characters was refused", MAX_CAFE_NAME_LENGTH)
+	}
+	handleMessage(ctx, cfg, say("取消"), a)
+
+	for _, step := range []struct {
+		msg   ambassador.Message
+		state string
+	}{
+		{say("新增咖啡店"), "SUBMIT_NAME"},
+		{say("河岸咖啡"), "SUBMIT_LOCATION"},
+		// the location is asked again until it is sent
+		{tap("SUBMIT_PLUG:yes"), "SUBMIT_LOCATION"},
+		{say("在河邊"), "SUBMIT_LOCATION"},
+		{sendLocation(25.0300, 121.5000), "SUBMIT_PLUG"},
+		{tap("SUBMIT_PLUG:yes"), "SUBMIT_TIME_LIMIT"},
+		{tap("SUBMIT_TIME_LIMIT:no"), "SUBMIT_RATING"},
+		{tap("SUBMIT_RATING:wifi:5"), "SUBMIT_RATING"},
+		// a reply to an earlier question is ignored
+		{tap("SUBMIT_RATING:wifi:1"), "SUBMIT_RATING"},
+		{tap("SUBMIT_RATING:quiet:0"), "SUBMIT_RATING"},
+		{tap("SUBMIT_RATING:tasty:4"), "SUBMIT_RATING"},
+		{tap("SUBMIT_RATING:cheap:3"), "STANDBY"},
+	} {
+		handleMessage(ctx, cfg, step.msg, a)
+		if user := session(); user.State != step.state {
+			t.Fatalf("got state %s, want %s", user.State, step.state)
+		}
+	}
+	if user := session(); user.Submission != nil {
+		t.Errorf("draft %+v kept after submitting", user.Submission)
+	}
+
+	list, _ := store.List(ctx)
+	if len(list) != 1 {
+		t.Fatalf("got submissions %+v", list)
+	}
+	s := list[0]
+	if s.Name != "河岸咖啡" || s.Status != "pending" || s.SenderId != "u" || s.Latitude != 25.0300 ||
+		s.Plug != "yes" || s.TimeLimited != "no" {
+		t.Errorf("got submission %+v", s)
+	}
+	if r := s.Ratings; r.Wifi != 5 || r.Quiet != 0 || r.Tasty != 4 || r.Price != 3 || r.SenderId != "u" {
+		t.Errorf("got ratings %+v", r)
+	}
+}
+
+func TestSubmissionOfAKnownCafe(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	defer useSampleCafes(t)()
+	_, restore := useMemorySessions()
+	defer restore()
+	store, restoreSubmissions := useMemorySubmissions()
+	defer restoreSubmissions()
+	cfg := testConfig()
+	a := newFakeAmbassador()
+
+	// the same name as sample-ximen-01, spelled otherwise, about 300 m away
+	handleMessage(ctx, cfg, say("新增咖啡店"), a)
+	handleMessage(ctx, cfg, say("西門 範例咖啡"), a)
+	handleMessage(ctx, cfg, sendLocation(25.0457, 121.5070), a)
+	if replies := a.lastReplies("u"); len(replies) == 0 || replies[0]["payload"] != "SUBMIT_PLUG:yes" {
+		t.Fatalf("a cafe of the same name 300 m away was taken for it: %v", replies)
+	}
+	handleMessage(ctx, cfg, tap("CANCEL"), a)
+
+	// about 45 m away
+	handleMessage(ctx, cfg, say("新增咖啡店"), a)
+	handleMessage(ctx, cfg, say("西門 範例咖啡"), a)
+	handleMessage(ctx, cfg, sendLocation(25.0434, 121.5070), a)
+	replies := a.lastReplies("u")
+	if len(replies) != 1 || replies[0]["payload"] != "CAFE_DETAIL:sample-ximen-01" {
+		t.Errorf("got replies %v, want the known cafe", replies)
+	}
+	if list, _ := store.List(ctx); len(list) != 0 {
+		t.Errorf("got submissions %+v", list)
+	}
+}
+
+func TestDuplicateCafe(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+	defer useSampleCafes(t)()
+
+	for _, c := range []struct {
+		name     string
+		lat, lng float64
+		want     string
+	}{
+		{"西門範例咖啡", 25.0430, 121.5070, "sample-ximen-01"},
+		{"西門範例咖啡", 25.0438, 121.5070, "sample-ximen-01"},
+		{"西門範例咖啡", 25.0440, 121.5070, ""},
+		{"西門範例咖啡", 25.0450, 121.5070, ""},
+		{"車站範例咖啡", 25.0430, 121.5070, ""},
+	} {
+		dup, err := duplicateCafe(ctx, c.name, c.lat, c.lng)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := ""; dup != nil {
+			got = dup.Id
+			if got != c.want {
+				t.Errorf("%s at %f,%f: got %s, want %q", c.name, c.lat, c.lng, got, c.want)
+			}
+		} else if c.want != "" {
+			t.Errorf("%s at %f,%f: got none, want %s", c.name, c.lat, c.lng, c.want)
+		}
+	}
+}
+
+func TestAdminSubmissions(t *testing.T) {
+	inst, err := aetest.NewInstance(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inst.Close()
+
+	defer useSampleCafes(t)()
+	store, restore := useMemorySubmissions()
+	defer restore()
+	a := newFakeAmbassador()
+	defer useFakeAmbassador(a)()
+	cfg := testConfig()
+	cfg.AdminToken = "test-admin-token"
+
+	ctx := context.Background()
+	store.Put(ctx, cafeSubmission{
+		Id: "s1", SenderId: "u", Name: "河岸咖啡", Latitude: 25.0300, Longitude: 121.5000,
+		Plug: "yes", TimeLimited: "no", Ratings: userRating{Wifi: 5, Tasty: 4},
+		Status: "pending", Time: time.Now(),
+	})
+	store.Put(ctx, cafeSubmission{
+		Id: "s2", SenderId: "v", Name: "山邊咖啡", Latitude: 25.0600, Longitude: 121.5000,
+		Status: "pending", Time: time.Now(),
+	})
+
+	serve := func(method, path, token string, body io.Reader) *httptest.ResponseRecorder {
+		r, err := inst.NewRequest(method, path, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		adminSubmissionsHandler(cfg, w, r)
+		return w
+	}
+
+	if w := serve("POST", "/admin/submissions/s1/approve", "", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("approved without a token: %d", w.Code)
+	}
+	if w := serve("POST", "/admin/submissions/s1/approve", "wrong", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("approved with a wrong token: %d", w.Code)
+	}
+	if w := serve("GET", "/admin/submissions/none", cfg.AdminToken, nil); w.Code != http.StatusNotFound {
+		t.Errorf("got %d for a missing submission", w.Code)
+	}
+
+	// corrections in the body can not make the cafe look imported
+	body := strings.NewReader(`{"name":"河岸咖啡","address":"台北市萬華區河岸路 1 號","source":""}`)
+	w := serve("POST", "/admin/submissions/s1/approve", cfg.AdminToken, body)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("got %d: %s", w.Code, w.Body)
+	}
+	s, _ := store.ByID(ctx, "s1")
+	if s.Status != "approved" || s.CafeId == "" {
+		t.Fatalf("got submission %+v", s)
+	}
+	cafe, err := cafeRepo.ByID(ctx, s.CafeId)
+	if err != nil || cafe == nil {
+		t.Fatalf("cafe %s not added: %v", s.CafeId, err)
+	}
+	if cafe.Source != "user" || cafe.Address != "台北市萬華區河岸路 1 號" || cafe.Plug != "yes" || cafe.Latitude != 25.0300 {
+		t.Errorf("got cafe %+v", cafe)
+	}
+	summaries, _ := ratings.Summaries(ctx, []string{cafe.Id})
+	if r := summaries[cafe.Id]; r.Count != 1 || r.Wifi != 5 {
+		t.Errorf("got ratings %+v", r)
+	}
+	if texts := a.texts("u"); len(texts) != 1 || !strings.Contains(texts[0], "通過審核") {
+		t.Errorf("told the submitter %q", texts)
+	}
+	if w := serve("POST", "/admin/submissions/s1/approve", cfg.AdminToken, nil); w.Code != http.StatusConflict {
+		t.Errorf("approved twice: %d", w.Code)
+	}
+
+	if w := serve("POST", "/admin/submissions/s2/reject", cfg.AdminToken, nil); w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body)
+	}
+	if s, _ := store.ByID(ctx, "s2"); s.Status != "rejected" || s.CafeId != "" {
+		t.Errorf("got submission %+v", s)
+	}
+	if nearby, _ := cafeRepo.Nearby(ctx, 25.0600, 121.5000, 100); len(nearby) != 0 {
+		t.Errorf("a rejected cafe was added: %+v", nearby)
+	}
+	if texts := a.texts("v"); len(texts) != 0 {
+		t.Errorf("told the submitter of a rejected cafe %q", texts)
+	}
+
+	w = serve("GET", "/admin/submissions?status=all", cfg.AdminToken, nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"total":2`) {
+		t.Errorf("got %d: %s", w.Code, w.Body)
+	}
+	w = serve("GET", "/admin/submissions", cfg.AdminToken, nil)
+	if !strings.Contains(w.Body.String(), `"total":0`) {
+		t.Errorf("listed decided submissions as pending: %s", w.Body)
+	}
+}